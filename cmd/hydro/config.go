@@ -9,17 +9,105 @@ import (
 )
 
 type config struct {
-	Listen        string        `env:"LISTEN" envDefault:"localhost:9000"`
-	Timeout       time.Duration `env:"TIMEOUT" envDefault:"10ms"`
-	LogLevel      string        `env:"LOG_LEVEL" envDefault:"info"`
-	LogFmt        string        `env:"LOG_FMT" envDefault:"console"`
-	StoreTimeFile string        `env:"ST_FILE" envDefault:"./tmp/time"`
-
-	MqttBroker     string `env:"MQTT_BROKER"`
-	InfluxDBURL    string `env:"INFLUX_URL" envDefault:"http://localhost:8086"`
-	InfluxDBToken  string `env:"INFLUX_TOKEN"`
-	InfluxDBOrg    string `env:"INFLUX_ORG"  envDefault:"kara"`
-	InfluxDBBucket string `env:"INFLUX_BUCKET"  envDefault:"hydroponic"`
+	Listen          string        `env:"LISTEN" envDefault:"localhost:9000"`
+	Timeout         time.Duration `env:"TIMEOUT" envDefault:"10ms"`
+	LogLevel        string        `env:"LOG_LEVEL" envDefault:"info"`
+	LogFmt          string        `env:"LOG_FMT" envDefault:"console"`
+	StoreTimeFile   string        `env:"ST_FILE" envDefault:"./tmp/time"`
+	CommandLogFile  string        `env:"COMMAND_LOG_FILE" envDefault:"./tmp/commands.jsonl"`
+	CommandLogSize  int64         `env:"COMMAND_LOG_MAX_SIZE" envDefault:"10485760"`
+	CommandLogFiles int           `env:"COMMAND_LOG_MAX_FILES" envDefault:"5"`
+	OutboxFile      string        `env:"OUTBOX_FILE" envDefault:"./tmp/outbox.json"`
+	OutboxTTL       time.Duration `env:"OUTBOX_TTL" envDefault:"2m"`
+	ShadowFile      string        `env:"SHADOW_FILE" envDefault:"./tmp/shadow.json"`
+	ShadowSaveDelay time.Duration `env:"SHADOW_SAVE_DELAY" envDefault:"1s"`
+
+	TLSCertFile       string        `env:"TLS_CERT_FILE"`
+	TLSKeyFile        string        `env:"TLS_KEY_FILE"`
+	TLSReloadInterval time.Duration `env:"TLS_RELOAD_INTERVAL" envDefault:"0s"`
+	ShutdownTimeout   time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"15s"`
+	// addresses or CIDR ranges of the reverse proxies allowed to set X-Forwarded-For and X-Real-IP
+	TrustedProxies []string `env:"TRUSTED_PROXIES" envSeparator:","`
+	// serves /metrics without credentials, for scrapers that can not send an api key
+	MetricsPublic bool `env:"METRICS_PUBLIC" envDefault:"false"`
+
+	OtlpEndpoint     string  `env:"OTLP_ENDPOINT"`
+	OtlpInsecure     bool    `env:"OTLP_INSECURE" envDefault:"false"`
+	TraceServiceName string  `env:"TRACE_SERVICE_NAME" envDefault:"hydro"`
+	TraceSampleRatio float64 `env:"TRACE_SAMPLE_RATIO" envDefault:"1"`
+
+	Devices         []string `env:"DEVICES" envSeparator:","`
+	DeviceDiscovery bool     `env:"DEVICE_DISCOVERY" envDefault:"true"`
+	// LegacyDevice serves the firmware publishing on hydroponic/{kind} and the data stored without a device tag
+	LegacyDevice string `env:"LEGACY_DEVICE"`
+
+	AuthDisabled bool     `env:"AUTH_DISABLED" envDefault:"false"`
+	APIKeys      []string `env:"API_KEYS" envSeparator:","`
+	JWTSecret    string   `env:"JWT_SECRET"`
+	JWTIssuer    string   `env:"JWT_ISSUER"`
+
+	MqttBroker          string        `env:"MQTT_BROKER"`
+	MqttAckTimeout      time.Duration `env:"MQTT_ACK_TIMEOUT" envDefault:"5s"`
+	MqttClientID        string        `env:"MQTT_CLIENT_ID" envDefault:"hydro_mqtt_client"`
+	MqttUsername        string        `env:"MQTT_USERNAME"`
+	MqttPassword        string        `env:"MQTT_PASSWORD"`
+	MqttCAFile          string        `env:"MQTT_CA_FILE"`
+	MqttCertFile        string        `env:"MQTT_CERT_FILE"`
+	MqttKeyFile         string        `env:"MQTT_KEY_FILE"`
+	MqttInsecure        bool          `env:"MQTT_INSECURE_SKIP_VERIFY" envDefault:"false"`
+	MqttConnectTimeout  time.Duration `env:"MQTT_CONNECT_TIMEOUT" envDefault:"30s"`
+	MqttKeepAlive       time.Duration `env:"MQTT_KEEP_ALIVE" envDefault:"30s"`
+	MqttRetryInterval   time.Duration `env:"MQTT_CONNECT_RETRY_INTERVAL" envDefault:"5s"`
+	MqttMaxReconnect    time.Duration `env:"MQTT_MAX_RECONNECT_INTERVAL" envDefault:"2m"`
+	InfluxDBURL         string        `env:"INFLUX_URL" envDefault:"http://localhost:8086"`
+	InfluxDBToken       string        `env:"INFLUX_TOKEN"`
+	InfluxDBOrg         string        `env:"INFLUX_ORG"  envDefault:"kara"`
+	InfluxDBBucket      string        `env:"INFLUX_BUCKET"  envDefault:"hydroponic"`
+	InfluxBatchSize     uint          `env:"INFLUX_BATCH_SIZE" envDefault:"50"`
+	InfluxFlushInterval time.Duration `env:"INFLUX_FLUSH_INTERVAL" envDefault:"1s"`
+	InfluxMaxRetries    uint          `env:"INFLUX_MAX_RETRIES" envDefault:"5"`
+	SensorCacheRefresh  time.Duration `env:"SENSOR_CACHE_REFRESH" envDefault:"1m"`
+
+	PhControlEnabled  bool          `env:"PH_CONTROL_ENABLED" envDefault:"false"`
+	PhTarget          float64       `env:"PH_TARGET" envDefault:"6.0"`
+	PhDeadband        float64       `env:"PH_DEADBAND" envDefault:"0.3"`
+	PhCheckInterval   time.Duration `env:"PH_CHECK_INTERVAL" envDefault:"1m"`
+	PhMaxDosesPerHour int           `env:"PH_MAX_DOSES_PER_HOUR" envDefault:"4"`
+	PhMinDoseInterval time.Duration `env:"PH_MIN_DOSE_INTERVAL" envDefault:"10m"`
+	PhSettlingTime    time.Duration `env:"PH_SETTLING_TIME" envDefault:"5m"`
+	PhMaxReadingAge   time.Duration `env:"PH_MAX_READING_AGE" envDefault:"10m"`
+	PhDoseMl          float64       `env:"PH_DOSE_ML" envDefault:"0"`
+
+	SafetyDoseCooldown   time.Duration `env:"SAFETY_DOSE_COOLDOWN" envDefault:"1m"`
+	SafetyDoseMaxPerHour int           `env:"SAFETY_DOSE_MAX_PER_HOUR" envDefault:"6"`
+	SafetyDoseMaxPerDay  int           `env:"SAFETY_DOSE_MAX_PER_DAY" envDefault:"24"`
+	// volume and pump run time budgets of every dosing command, a dose without ml or durationMs counts the defaults
+	SafetyDoseMaxMlPerHour  float64       `env:"SAFETY_DOSE_MAX_ML_PER_HOUR" envDefault:"0"`
+	SafetyDoseMaxMlPerDay   float64       `env:"SAFETY_DOSE_MAX_ML_PER_DAY" envDefault:"0"`
+	SafetyDoseMaxRunPerHour time.Duration `env:"SAFETY_DOSE_MAX_RUN_PER_HOUR" envDefault:"0s"`
+	SafetyDoseMaxRunPerDay  time.Duration `env:"SAFETY_DOSE_MAX_RUN_PER_DAY" envDefault:"0s"`
+	SafetyDoseDefaultMl     float64       `env:"SAFETY_DOSE_DEFAULT_ML" envDefault:"0"`
+	SafetyDoseDefaultRun    time.Duration `env:"SAFETY_DOSE_DEFAULT_RUN" envDefault:"0s"`
+	SafetyLightCooldown     time.Duration `env:"SAFETY_LIGHT_COOLDOWN" envDefault:"10s"`
+	SafetyLightMaxPerHour   int           `env:"SAFETY_LIGHT_MAX_PER_HOUR" envDefault:"30"`
+	SafetyLightMaxPerDay    int           `env:"SAFETY_LIGHT_MAX_PER_DAY" envDefault:"0"`
+	SafetyWaterMaxAge       time.Duration `env:"SAFETY_WATER_MAX_AGE" envDefault:"10m"`
+
+	LightScheduleFile     string        `env:"LIGHT_SCHEDULE_FILE"`
+	LightScheduleInterval time.Duration `env:"LIGHT_SCHEDULE_INTERVAL" envDefault:"30s"`
+	LightReportTimeout    time.Duration `env:"LIGHT_REPORT_TIMEOUT" envDefault:"5m"`
+
+	AlertRulesFile      string   `env:"ALERT_RULES_FILE"`
+	AlertDeviceErrors   bool     `env:"ALERT_DEVICE_ERRORS" envDefault:"true"`
+	AlertWebhookURL     string   `env:"ALERT_WEBHOOK_URL"`
+	AlertSMTPAddr       string   `env:"ALERT_SMTP_ADDR"`
+	AlertSMTPUsername   string   `env:"ALERT_SMTP_USERNAME"`
+	AlertSMTPPassword   string   `env:"ALERT_SMTP_PASSWORD"`
+	AlertSMTPFrom       string   `env:"ALERT_SMTP_FROM"`
+	AlertSMTPTo         []string `env:"ALERT_SMTP_TO" envSeparator:","`
+	AlertTelegramURL    string   `env:"ALERT_TELEGRAM_URL" envDefault:"https://api.telegram.org"`
+	AlertTelegramToken  string   `env:"ALERT_TELEGRAM_TOKEN"`
+	AlertTelegramChatID string   `env:"ALERT_TELEGRAM_CHAT_ID"`
 }
 
 func load() (*config, error) {
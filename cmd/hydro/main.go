@@ -39,6 +39,14 @@ func main() {
 `)
 	log.Debug().Msg("logger initialized")
 
+	shutdownTracing, err := internal.InitTracing(ctx, initTracingConfig(cfg))
+	if err != nil {
+		log.Err(err).Msg("error while configure tracing")
+		return
+	}
+	// bound before the app so the spans of the shutdown are flushed
+	closer.Bind(shutdownTracing)
+
 	log.Debug().Msg("starting di container")
 
 	log.Debug().Msg("starting db")
@@ -49,6 +57,14 @@ func main() {
 		return
 	}
 	closer.Bind(connCLoser)
+	// bound last so it runs first, before the connections are closed
+	closer.Bind(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := a.Shutdown(ctx); err != nil {
+			log.Err(err).Msg("api was not shut down gracefully")
+		}
+	})
 
 	log.Debug().Msg("starting web application")
 	if err = a.Run(); err != nil {
@@ -56,9 +72,47 @@ func main() {
 	}
 }
 
+func initTracingConfig(c *config) *internal.TracingConfig {
+	return &internal.TracingConfig{
+		Endpoint:    c.OtlpEndpoint,
+		Insecure:    c.OtlpInsecure,
+		ServiceName: c.TraceServiceName,
+		SampleRatio: c.TraceSampleRatio,
+	}
+}
+
+func initDeviceConfig(c *config) *internal.DeviceConfig {
+	return &internal.DeviceConfig{
+		Devices:   c.Devices,
+		Discovery: c.DeviceDiscovery,
+		Legacy:    c.LegacyDevice,
+	}
+}
+
+func initAuthConfig(c *config) *internal.AuthConfig {
+	return &internal.AuthConfig{
+		Disabled:  c.AuthDisabled,
+		APIKeys:   c.APIKeys,
+		JWTSecret: c.JWTSecret,
+		JWTIssuer: c.JWTIssuer,
+	}
+}
+
 func initMqttConfig(c *config) *internal.MqttConfig {
 	return &internal.MqttConfig{
-		MqttBroker: c.MqttBroker,
+		MqttBroker:           c.MqttBroker,
+		AckTimeout:           c.MqttAckTimeout,
+		ClientID:             c.MqttClientID,
+		Username:             c.MqttUsername,
+		Password:             c.MqttPassword,
+		CAFile:               c.MqttCAFile,
+		CertFile:             c.MqttCertFile,
+		KeyFile:              c.MqttKeyFile,
+		InsecureSkipVerify:   c.MqttInsecure,
+		ConnectTimeout:       c.MqttConnectTimeout,
+		KeepAlive:            c.MqttKeepAlive,
+		ConnectRetryInterval: c.MqttRetryInterval,
+		MaxReconnectInterval: c.MqttMaxReconnect,
 	}
 }
 
@@ -68,17 +122,117 @@ func initTimeConfig(c *config) *internal.FileTimeLoaderConfig {
 	}
 }
 
+func initOutboxConfig(c *config) *internal.OutboxConfig {
+	return &internal.OutboxConfig{
+		File: c.OutboxFile,
+		TTL:  c.OutboxTTL,
+	}
+}
+
+func initShadowConfig(c *config) *internal.ShadowConfig {
+	return &internal.ShadowConfig{
+		File:      c.ShadowFile,
+		SaveDelay: c.ShadowSaveDelay,
+	}
+}
+
+func initCommandLogConfig(c *config) *internal.CommandLogConfig {
+	return &internal.CommandLogConfig{
+		File:     c.CommandLogFile,
+		MaxSize:  c.CommandLogSize,
+		MaxFiles: c.CommandLogFiles,
+	}
+}
+
 func initDbConfig(c *config) *internal.InfluxConfig {
 	return &internal.InfluxConfig{
 		InfluxDBURL:          c.InfluxDBURL,
 		InfluxDBToken:        c.InfluxDBToken,
 		InfluxDBOrganization: c.InfluxDBOrg,
 		InfluxDBBucket:       c.InfluxDBBucket,
+		BatchSize:            c.InfluxBatchSize,
+		FlushInterval:        c.InfluxFlushInterval,
+		MaxRetries:           c.InfluxMaxRetries,
+		LegacyDevice:         c.LegacyDevice,
+	}
+}
+
+func initSensorCacheConfig(c *config) *internal.SensorCacheConfig {
+	return &internal.SensorCacheConfig{
+		RefreshInterval: c.SensorCacheRefresh,
+	}
+}
+
+func initPhControlConfig(c *config) *internal.PhControlConfig {
+	return &internal.PhControlConfig{
+		Enabled:         c.PhControlEnabled,
+		Target:          c.PhTarget,
+		Deadband:        c.PhDeadband,
+		CheckInterval:   c.PhCheckInterval,
+		MaxDosesPerHour: c.PhMaxDosesPerHour,
+		MinDoseInterval: c.PhMinDoseInterval,
+		SettlingTime:    c.PhSettlingTime,
+		MaxReadingAge:   c.PhMaxReadingAge,
+		DoseMl:          c.PhDoseMl,
+	}
+}
+
+func initSafetyConfig(c *config) *internal.SafetyConfig {
+	return &internal.SafetyConfig{
+		Dose: internal.SafetyLimits{
+			Cooldown:      c.SafetyDoseCooldown,
+			MaxPerHour:    c.SafetyDoseMaxPerHour,
+			MaxPerDay:     c.SafetyDoseMaxPerDay,
+			MaxMlPerHour:  c.SafetyDoseMaxMlPerHour,
+			MaxMlPerDay:   c.SafetyDoseMaxMlPerDay,
+			MaxRunPerHour: c.SafetyDoseMaxRunPerHour,
+			MaxRunPerDay:  c.SafetyDoseMaxRunPerDay,
+			DefaultMl:     c.SafetyDoseDefaultMl,
+			DefaultRun:    c.SafetyDoseDefaultRun,
+		},
+		Light: internal.SafetyLimits{
+			Cooldown:   c.SafetyLightCooldown,
+			MaxPerHour: c.SafetyLightMaxPerHour,
+			MaxPerDay:  c.SafetyLightMaxPerDay,
+		},
+		MaxWaterReadingAge: c.SafetyWaterMaxAge,
+	}
+}
+
+func initLightScheduleConfig(c *config) *internal.LightScheduleConfig {
+	return &internal.LightScheduleConfig{
+		File:          c.LightScheduleFile,
+		CheckInterval: c.LightScheduleInterval,
+		ReportTimeout: c.LightReportTimeout,
+	}
+}
+
+func initAlertConfig(c *config) *internal.AlertConfig {
+	return &internal.AlertConfig{
+		RulesFile:          c.AlertRulesFile,
+		NotifyDeviceErrors: c.AlertDeviceErrors,
+		WebhookURL:         c.AlertWebhookURL,
+		SMTPAddr:           c.AlertSMTPAddr,
+		SMTPUsername:       c.AlertSMTPUsername,
+		SMTPPassword:       c.AlertSMTPPassword,
+		SMTPFrom:           c.AlertSMTPFrom,
+		SMTPTo:             c.AlertSMTPTo,
+		TelegramURL:        c.AlertTelegramURL,
+		TelegramToken:      c.AlertTelegramToken,
+		TelegramChatID:     c.AlertTelegramChatID,
 	}
 }
 
 func initWebAppCfg(c *config) (internal.AppConfig, error) {
-	return internal.AppConfig{Timeout: c.Timeout, NetInterface: c.Listen}, nil
+	return internal.AppConfig{
+		Timeout:           c.Timeout,
+		NetInterface:      c.Listen,
+		TLSCertFile:       c.TLSCertFile,
+		TLSKeyFile:        c.TLSKeyFile,
+		TLSReloadInterval: c.TLSReloadInterval,
+		TrustedProxies:    c.TrustedProxies,
+		MetricsPublic:     c.MetricsPublic,
+	}, nil
 }
 
 func initLogger(c *config) error {
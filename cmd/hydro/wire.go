@@ -10,13 +10,27 @@ import (
 )
 
 var (
+	deviceSetter = wire.NewSet(
+		initDeviceConfig,
+		internal.NewDeviceRegistry,
+	)
+
+	authSetter = wire.NewSet(
+		initAuthConfig,
+		internal.NewAuthenticator,
+	)
+
 	clientSetter = wire.NewSet(
 		initMqttConfig,
 		wire.Bind(
-			new(internal.HydroponicClient),
+			new(internal.TelemetrySource),
 			new(*internal.MqttHydroponicClient),
 		),
+		initOutboxConfig,
+		internal.NewOutbox,
 		internal.NewMqttHydroponicClient,
+		internal.NewEventHub,
+		internal.NewMetrics,
 	)
 
 	dbSetter = wire.NewSet(
@@ -26,6 +40,34 @@ var (
 			new(*internal.HydroponicInfluxRepo),
 		),
 		internal.NewHydroponicRepo,
+		internal.NewIngestor,
+	)
+
+	cacheSetter = wire.NewSet(
+		initSensorCacheConfig,
+		wire.Bind(
+			new(internal.PhSource),
+			new(*internal.SensorCache),
+		),
+		wire.Bind(
+			new(internal.WaterLevelSource),
+			new(*internal.SensorCache),
+		),
+		internal.NewSensorCache,
+	)
+
+	safetySetter = wire.NewSet(
+		initSafetyConfig,
+		wire.Bind(
+			new(internal.HydroponicClient),
+			new(*internal.SafeClient),
+		),
+		internal.NewSafeClient,
+	)
+
+	auditSetter = wire.NewSet(
+		initCommandLogConfig,
+		internal.NewCommandLog,
 	)
 
 	timeSetter = wire.NewSet(
@@ -36,9 +78,33 @@ var (
 		),
 		internal.NewFileTimeLoader,
 	)
+
+	phControlSetter = wire.NewSet(
+		initPhControlConfig,
+		internal.NewPhController,
+	)
+
+	shadowSetter = wire.NewSet(
+		initShadowConfig,
+		internal.NewShadow,
+		wire.Bind(
+			new(internal.LightStateSource),
+			new(*internal.Shadow),
+		),
+	)
+
+	lightScheduleSetter = wire.NewSet(
+		initLightScheduleConfig,
+		internal.NewLightScheduler,
+	)
+
+	alertSetter = wire.NewSet(
+		initAlertConfig,
+		internal.NewAlertEngine,
+	)
 )
 
 func initWebApp(ctx context.Context, c *config) (*internal.API, func(), error) {
-	wire.Build(initWebAppCfg, timeSetter, clientSetter, dbSetter, internal.NewApp)
+	wire.Build(initWebAppCfg, authSetter, deviceSetter, timeSetter, clientSetter, dbSetter, cacheSetter, safetySetter, auditSetter, shadowSetter, phControlSetter, lightScheduleSetter, alertSetter, internal.NewApp)
 	return nil, nil, nil
 }
@@ -19,32 +19,124 @@ func initWebApp(ctx context.Context, c *config) (*internal.API, func(), error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	authConfig := initAuthConfig(c)
+	authenticator, err := internal.NewAuthenticator(authConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	deviceConfig := initDeviceConfig(c)
+	deviceRegistry, err := internal.NewDeviceRegistry(deviceConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	safetyConfig := initSafetyConfig(c)
 	mqttConfig := initMqttConfig(c)
-	mqttHydroponicClient, cleanup, err := internal.NewMqttHydroponicClient(mqttConfig)
+	outboxConfig := initOutboxConfig(c)
+	outbox, err := internal.NewOutbox(outboxConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	mqttHydroponicClient, cleanup, err := internal.NewMqttHydroponicClient(mqttConfig, deviceRegistry, outbox)
 	if err != nil {
 		return nil, nil, err
 	}
+	sensorCacheConfig := initSensorCacheConfig(c)
 	influxConfig := initDbConfig(c)
 	hydroponicInfluxRepo, cleanup2, err := internal.NewHydroponicRepo(ctx, influxConfig)
 	if err != nil {
 		cleanup()
 		return nil, nil, err
 	}
+	sensorCache, cleanup3, err := internal.NewSensorCache(ctx, sensorCacheConfig, deviceRegistry, mqttHydroponicClient, hydroponicInfluxRepo)
+	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	safeClient := internal.NewSafeClient(safetyConfig, mqttHydroponicClient, sensorCache)
 	fileTimeLoaderConfig := initTimeConfig(c)
-	fileTimeLoader, cleanup3, err := internal.NewFileTimeLoader(fileTimeLoaderConfig)
+	fileTimeLoader, cleanup4, err := internal.NewFileTimeLoader(fileTimeLoaderConfig)
 	if err != nil {
+		cleanup3()
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	phControlConfig := initPhControlConfig(c)
+	phController, cleanup5, err := internal.NewPhController(ctx, phControlConfig, deviceRegistry, safeClient, sensorCache)
+	if err != nil {
+		cleanup4()
+		cleanup3()
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	lightScheduleConfig := initLightScheduleConfig(c)
+	shadowConfig := initShadowConfig(c)
+	shadow, cleanup6, err := internal.NewShadow(shadowConfig, deviceRegistry, mqttHydroponicClient)
+	if err != nil {
+		cleanup5()
+		cleanup4()
+		cleanup3()
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	lightScheduler, cleanup7, err := internal.NewLightScheduler(ctx, lightScheduleConfig, deviceRegistry, safeClient, shadow, fileTimeLoader)
+	if err != nil {
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
 		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	api, err := internal.NewApp(ctx, appConfig, mqttHydroponicClient, hydroponicInfluxRepo, fileTimeLoader)
+	ingestor := internal.NewIngestor(ctx, mqttHydroponicClient, hydroponicInfluxRepo)
+	eventHub := internal.NewEventHub(mqttHydroponicClient)
+	alertConfig := initAlertConfig(c)
+	alertEngine, err := internal.NewAlertEngine(ctx, alertConfig, deviceRegistry, mqttHydroponicClient)
 	if err != nil {
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	commandLogConfig := initCommandLogConfig(c)
+	commandLog, cleanup8, err := internal.NewCommandLog(commandLogConfig, mqttHydroponicClient)
+	if err != nil {
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
+		cleanup3()
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	metrics := internal.NewMetrics(mqttHydroponicClient)
+	api, err := internal.NewApp(ctx, appConfig, authenticator, deviceRegistry, safeClient, hydroponicInfluxRepo, fileTimeLoader, phController, lightScheduler, ingestor, sensorCache, eventHub, alertEngine, commandLog, outbox, shadow, metrics)
+	if err != nil {
+		cleanup8()
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
 		cleanup3()
 		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
 	return api, func() {
+		cleanup8()
+		cleanup7()
+		cleanup6()
+		cleanup5()
+		cleanup4()
 		cleanup3()
 		cleanup2()
 		cleanup()
@@ -54,18 +146,47 @@ func initWebApp(ctx context.Context, c *config) (*internal.API, func(), error) {
 // wire.go:
 
 var (
+	deviceSetter = wire.NewSet(
+		initDeviceConfig, internal.NewDeviceRegistry,
+	)
+
+	authSetter = wire.NewSet(
+		initAuthConfig, internal.NewAuthenticator,
+	)
+
 	clientSetter = wire.NewSet(
 		initMqttConfig, wire.Bind(
-			new(internal.HydroponicClient),
+			new(internal.TelemetrySource),
 			new(*internal.MqttHydroponicClient),
-		), internal.NewMqttHydroponicClient,
+		), initOutboxConfig, internal.NewOutbox, internal.NewMqttHydroponicClient, internal.NewEventHub, internal.NewMetrics,
 	)
 
 	dbSetter = wire.NewSet(
 		initDbConfig, wire.Bind(
 			new(internal.HydroponicRepo),
 			new(*internal.HydroponicInfluxRepo),
-		), internal.NewHydroponicRepo,
+		), internal.NewHydroponicRepo, internal.NewIngestor,
+	)
+
+	cacheSetter = wire.NewSet(
+		initSensorCacheConfig, wire.Bind(
+			new(internal.PhSource),
+			new(*internal.SensorCache),
+		), wire.Bind(
+			new(internal.WaterLevelSource),
+			new(*internal.SensorCache),
+		), internal.NewSensorCache,
+	)
+
+	safetySetter = wire.NewSet(
+		initSafetyConfig, wire.Bind(
+			new(internal.HydroponicClient),
+			new(*internal.SafeClient),
+		), internal.NewSafeClient,
+	)
+
+	auditSetter = wire.NewSet(
+		initCommandLogConfig, internal.NewCommandLog,
 	)
 
 	timeSetter = wire.NewSet(
@@ -74,4 +195,23 @@ var (
 			new(*internal.FileTimeLoader),
 		), internal.NewFileTimeLoader,
 	)
+
+	phControlSetter = wire.NewSet(
+		initPhControlConfig, internal.NewPhController,
+	)
+
+	shadowSetter = wire.NewSet(
+		initShadowConfig, internal.NewShadow, wire.Bind(
+			new(internal.LightStateSource),
+			new(*internal.Shadow),
+		),
+	)
+
+	lightScheduleSetter = wire.NewSet(
+		initLightScheduleConfig, internal.NewLightScheduler,
+	)
+
+	alertSetter = wire.NewSet(
+		initAlertConfig, internal.NewAlertEngine,
+	)
 )
@@ -0,0 +1,364 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// AlertStatus is the state of an alert rule.
+type AlertStatus string
+
+const (
+	AlertInactive     AlertStatus = "inactive"
+	AlertPending      AlertStatus = "pending"
+	AlertFiring       AlertStatus = "firing"
+	AlertAcknowledged AlertStatus = "acknowledged"
+	AlertResolved     AlertStatus = "resolved"
+)
+
+const notifyTimeout = 10 * time.Second
+
+var (
+	// ErrUnknownAlert is returned when acknowledging an alert rule that does not exist.
+	ErrUnknownAlert = errors.New("unknown alert rule")
+	// ErrAlertNotFiring is returned when acknowledging an alert that is not firing.
+	ErrAlertNotFiring = errors.New("alert is not firing")
+)
+
+// Comparator compares a reading with the rule threshold.
+type Comparator string
+
+func (c Comparator) compare(v, threshold float64) bool {
+	switch c {
+	case "<":
+		return v < threshold
+	case "<=":
+		return v <= threshold
+	case ">":
+		return v > threshold
+	case ">=":
+		return v >= threshold
+	case "==":
+		return v == threshold
+	case "!=":
+		return v != threshold
+	}
+	return false
+}
+
+// cleared reports whether v is back on the safe side of the threshold by more than the hysteresis.
+func (c Comparator) cleared(v, threshold, hysteresis float64) bool {
+	switch c {
+	case "<", "<=":
+		return v >= threshold+hysteresis
+	case ">", ">=":
+		return v <= threshold-hysteresis
+	}
+	return !c.compare(v, threshold)
+}
+
+// Duration is a time.Duration encoded as a string like "5m" in json.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// AlertRule fires when Field compares with Threshold by Op for at least For and resolves when the
+// reading moves back past the threshold by Hysteresis. The water level flag compares as 0 or 1.
+type AlertRule struct {
+	Name       string      `json:"name"`
+	Field      SensorField `json:"field"`
+	Op         Comparator  `json:"op"`
+	Threshold  float64     `json:"threshold"`
+	For        Duration    `json:"for"`
+	Hysteresis float64     `json:"hysteresis"`
+	Notifiers  []string    `json:"notifiers,omitempty"`
+}
+
+func (r *AlertRule) check(notifiers map[string]Notifier) error {
+	if r.Name == "" {
+		return errors.New("alert rule without name")
+	}
+	f, err := ParseSensorField(string(r.Field))
+	if err != nil {
+		return errors.Wrapf(err, "alert rule %s", r.Name)
+	}
+	r.Field = f
+	switch r.Op {
+	case "<", "<=", ">", ">=", "==", "!=":
+	default:
+		return fmt.Errorf("alert rule %s has unknown comparator %q", r.Name, r.Op)
+	}
+	if r.Hysteresis < 0 || r.For < 0 {
+		return fmt.Errorf("alert rule %s has negative hysteresis or duration", r.Name)
+	}
+	for _, n := range r.Notifiers {
+		if _, ok := notifiers[n]; !ok {
+			return fmt.Errorf("alert rule %s uses notifier %s which is not configured", r.Name, n)
+		}
+	}
+	return nil
+}
+
+// AlertState is the current state of a rule on a device exposed through the API.
+type AlertState struct {
+	Device         string      `json:"device"`
+	Rule           AlertRule   `json:"rule"`
+	Status         AlertStatus `json:"status"`
+	Value          *float64    `json:"value"`
+	Since          *time.Time  `json:"since"`
+	FiredAt        *time.Time  `json:"firedAt"`
+	ResolvedAt     *time.Time  `json:"resolvedAt"`
+	AcknowledgedAt *time.Time  `json:"acknowledgedAt"`
+}
+
+// AlertConfig structure containing the alert rules file and the notifiers settings,
+// a notifier is enabled when its address is set.
+type AlertConfig struct {
+	RulesFile          string
+	NotifyDeviceErrors bool
+
+	WebhookURL string
+
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+	SMTPTo       []string
+
+	TelegramURL    string
+	TelegramToken  string
+	TelegramChatID string
+}
+
+func (ac *AlertConfig) notifiers() map[string]Notifier {
+	client := &http.Client{Timeout: notifyTimeout}
+	n := make(map[string]Notifier)
+	if ac.WebhookURL != "" {
+		n["webhook"] = &WebhookNotifier{URL: ac.WebhookURL, Client: client}
+	}
+	if ac.SMTPAddr != "" {
+		n["smtp"] = &SMTPNotifier{
+			Addr:     ac.SMTPAddr,
+			Username: ac.SMTPUsername,
+			Password: ac.SMTPPassword,
+			From:     ac.SMTPFrom,
+			To:       ac.SMTPTo,
+		}
+	}
+	if ac.TelegramToken != "" {
+		n["telegram"] = &TelegramNotifier{
+			BaseURL: ac.TelegramURL,
+			Token:   ac.TelegramToken,
+			ChatID:  ac.TelegramChatID,
+			Client:  client,
+		}
+	}
+	return n
+}
+
+// AlertEngine evaluates the alert rules against incoming sensor data and sends notifications.
+type AlertEngine struct {
+	ctx       context.Context
+	notifiers map[string]Notifier
+	rules     []AlertRule
+
+	mu     sync.Mutex
+	alerts []*AlertState
+}
+
+// NewAlertEngine loads the rules, which apply to every device, and subscribes to the telemetry source.
+func NewAlertEngine(ctx context.Context, cfg *AlertConfig, reg *DeviceRegistry, src TelemetrySource) (*AlertEngine, error) {
+	var rules []AlertRule
+	if cfg.RulesFile != "" {
+		data, err := os.ReadFile(cfg.RulesFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not read alert rules")
+		}
+		if err = json.Unmarshal(data, &rules); err != nil {
+			return nil, errors.Wrap(err, "can not parse alert rules")
+		}
+	}
+	e, err := newAlertEngine(ctx, cfg.notifiers(), rules, reg.IDs())
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Int("rules", len(rules)).Int("notifiers", len(e.notifiers)).Msg("alert engine initialized")
+
+	src.OnSensorData(e.evaluate)
+	if cfg.NotifyDeviceErrors {
+		src.OnDeviceError(e.deviceError)
+	}
+	return e, nil
+}
+
+func newAlertEngine(ctx context.Context, notifiers map[string]Notifier, rules []AlertRule, devices []string) (*AlertEngine, error) {
+	e := &AlertEngine{ctx: ctx, notifiers: notifiers, rules: rules}
+	for i := range rules {
+		if err := rules[i].check(notifiers); err != nil {
+			return nil, err
+		}
+	}
+	for _, device := range devices {
+		e.deviceAlerts(device)
+	}
+	return e, nil
+}
+
+// deviceAlerts returns the alerts of the device, creating them for devices discovered after startup.
+func (e *AlertEngine) deviceAlerts(device string) []*AlertState {
+	res := make([]*AlertState, 0, len(e.rules))
+	for _, a := range e.alerts {
+		if a.Device == device {
+			res = append(res, a)
+		}
+	}
+	if len(res) > 0 {
+		return res
+	}
+	for _, r := range e.rules {
+		a := &AlertState{Device: device, Rule: r, Status: AlertInactive}
+		e.alerts = append(e.alerts, a)
+		res = append(res, a)
+	}
+	return res
+}
+
+func (e *AlertEngine) evaluate(d SensorData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, a := range e.deviceAlerts(d.Device) {
+		v, ok := d.value(a.Rule.Field)
+		if !ok {
+			continue
+		}
+		a.Value = &v
+		e.transition(a, v, d.Timestamp)
+	}
+}
+
+func (e *AlertEngine) transition(a *AlertState, v float64, ts time.Time) {
+	r := a.Rule
+	switch a.Status {
+	case AlertInactive, AlertResolved:
+		if !r.Op.compare(v, r.Threshold) {
+			return
+		}
+		a.Status, a.Since = AlertPending, &ts
+		fallthrough
+	case AlertPending:
+		if !r.Op.compare(v, r.Threshold) {
+			a.Status, a.Since = AlertInactive, &ts
+			return
+		}
+		if ts.Sub(*a.Since) < time.Duration(r.For) {
+			return
+		}
+		a.Status, a.FiredAt, a.AcknowledgedAt = AlertFiring, &ts, nil
+		e.notify(r, Notification{
+			State:   AlertFiring,
+			Message: fmt.Sprintf("%s on %s: %s is %g, %s %g", r.Name, a.Device, r.Field, v, r.Op, r.Threshold),
+		}, a.Device, v, ts)
+	case AlertFiring, AlertAcknowledged:
+		if !r.Op.cleared(v, r.Threshold, r.Hysteresis) {
+			return
+		}
+		a.Status, a.Since, a.ResolvedAt = AlertResolved, &ts, &ts
+		e.notify(r, Notification{
+			State:   AlertResolved,
+			Message: fmt.Sprintf("%s resolved on %s: %s is %g", r.Name, a.Device, r.Field, v),
+		}, a.Device, v, ts)
+	}
+}
+
+func (e *AlertEngine) notify(r AlertRule, n Notification, device string, v float64, ts time.Time) {
+	n.Rule, n.Device, n.Field, n.Value, n.Threshold, n.Timestamp = r.Name, device, r.Field, &v, &r.Threshold, ts
+	log.Warn().Str("rule", r.Name).Str("device", device).Str("state", string(n.State)).Float64("value", v).Msg("alert changed state")
+	e.send(r.Notifiers, n)
+}
+
+func (e *AlertEngine) deviceError(de DeviceError) {
+	e.send(nil, Notification{
+		Rule:      "device_error",
+		Device:    de.Device,
+		State:     AlertFiring,
+		Message:   fmt.Sprintf("controller %s reported error on %s: %s", de.Device, de.Topic, de.Err),
+		Timestamp: de.Timestamp,
+	})
+}
+
+// send delivers n in the background to the named notifiers, or to all of them when names is empty.
+func (e *AlertEngine) send(names []string, n Notification) {
+	targets := make([]Notifier, 0, len(e.notifiers))
+	if len(names) == 0 {
+		for _, nt := range e.notifiers {
+			targets = append(targets, nt)
+		}
+	}
+	for _, name := range names {
+		targets = append(targets, e.notifiers[name])
+	}
+	for _, nt := range targets {
+		go func(nt Notifier) {
+			ctx, cancel := context.WithTimeout(e.ctx, notifyTimeout)
+			defer cancel()
+			if err := nt.Notify(ctx, n); err != nil {
+				log.Error().Err(err).Str("notifier", nt.Name()).Str("rule", n.Rule).Msg("can not send notification")
+			}
+		}(nt)
+	}
+}
+
+// Alerts returns the state of every rule on the device ordered by name.
+func (e *AlertEngine) Alerts(device string) []AlertState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alerts := e.deviceAlerts(device)
+	res := make([]AlertState, 0, len(alerts))
+	for _, a := range alerts {
+		res = append(res, *a)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Rule.Name < res[j].Rule.Name })
+	return res
+}
+
+// Acknowledge marks a firing alert of the device as acknowledged.
+func (e *AlertEngine) Acknowledge(device, name string, now time.Time) (AlertState, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, a := range e.deviceAlerts(device) {
+		if a.Rule.Name != name {
+			continue
+		}
+		if a.Status != AlertFiring {
+			return *a, ErrAlertNotFiring
+		}
+		a.Status, a.AcknowledgedAt = AlertAcknowledged, &now
+		log.Info().Str("rule", name).Str("device", device).Msg("alert acknowledged")
+		return *a, nil
+	}
+	return AlertState{}, ErrUnknownAlert
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type recordingNotifier struct {
+	sent chan Notification
+}
+
+func (r *recordingNotifier) Name() string {
+	return "recording"
+}
+
+func (r *recordingNotifier) Notify(_ context.Context, n Notification) error {
+	r.sent <- n
+	return nil
+}
+
+func (r *recordingNotifier) next(t *testing.T) Notification {
+	t.Helper()
+	select {
+	case n := <-r.sent:
+		return n
+	case <-time.After(time.Second):
+		t.Fatal("notification was not sent")
+	}
+	return Notification{}
+}
+
+func TestAlertEngineTransitions(t *testing.T) {
+	rec := &recordingNotifier{sent: make(chan Notification, 4)}
+	rules := []AlertRule{{
+		Name:       "low-ph",
+		Field:      "pH",
+		Op:         "<",
+		Threshold:  5.5,
+		For:        Duration(time.Minute),
+		Hysteresis: 0.2,
+	}}
+	e, err := newAlertEngine(context.Background(), map[string]Notifier{"recording": rec}, rules, []string{"tank-1", "tank-2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	feed := func(ph float64, after time.Duration) AlertStatus {
+		e.evaluate(SensorData{Device: "tank-1", PH: &ph, Timestamp: start.Add(after)})
+		return e.Alerts("tank-1")[0].Status
+	}
+
+	if st := feed(5.0, 0); st != AlertPending {
+		t.Fatalf("status %s, want pending", st)
+	}
+	if st := feed(5.0, 30*time.Second); st != AlertPending {
+		t.Fatalf("status %s before the rule duration, want pending", st)
+	}
+	if st := feed(5.0, time.Minute); st != AlertFiring {
+		t.Fatalf("status %s, want firing", st)
+	}
+	if n := rec.next(t); n.State != AlertFiring || n.Rule != "low-ph" || n.Device != "tank-1" || *n.Value != 5.0 {
+		t.Errorf("unexpected notification %+v", n)
+	}
+	if st := e.Alerts("tank-2")[0].Status; st != AlertInactive {
+		t.Errorf("status %s on another device, want inactive", st)
+	}
+	if _, err := e.Acknowledge("tank-2", "low-ph", start); err != ErrAlertNotFiring {
+		t.Errorf("acknowledging on another device returned %v", err)
+	}
+
+	if _, err := e.Acknowledge("tank-1", "low-ph", start.Add(2*time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if st := feed(5.6, 3*time.Minute); st != AlertAcknowledged {
+		t.Fatalf("status %s inside the hysteresis, want acknowledged", st)
+	}
+	if st := feed(5.8, 4*time.Minute); st != AlertResolved {
+		t.Fatalf("status %s, want resolved", st)
+	}
+	if n := rec.next(t); n.State != AlertResolved {
+		t.Errorf("unexpected notification %+v", n)
+	}
+
+	if _, err := e.Acknowledge("tank-1", "low-ph", start); err != ErrAlertNotFiring {
+		t.Errorf("acknowledging a resolved alert returned %v", err)
+	}
+	if _, err := e.Acknowledge("tank-1", "unknown", start); err != ErrUnknownAlert {
+		t.Errorf("acknowledging an unknown alert returned %v", err)
+	}
+}
+
+func TestAlertRuleCheck(t *testing.T) {
+	notifiers := map[string]Notifier{"recording": &recordingNotifier{}}
+	for _, r := range []AlertRule{
+		{Field: "pH", Op: "<"},
+		{Name: "a", Field: "temperature", Op: "<"},
+		{Name: "a", Field: "pH", Op: "~"},
+		{Name: "a", Field: "pH", Op: "<", Hysteresis: -1},
+		{Name: "a", Field: "pH", Op: "<", Notifiers: []string{"smtp"}},
+	} {
+		if err := r.check(notifiers); err == nil {
+			t.Errorf("rule %+v accepted", r)
+		}
+	}
+}
@@ -2,36 +2,73 @@ package internal
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/labstack/echo"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const sseHeartbeat = 15 * time.Second
+
 // Context structure for handle context from main.
 type Context struct {
 	echo.Context
 	Ctx context.Context
+	// RemoteIP is the address of the caller, behind a trusted proxy the one it forwarded.
+	RemoteIP string
 }
 
 // API structure containing the necessary server settings and responsible for starting and stopping it.
 type API struct {
 	e    *echo.Echo
 	addr string
+	reg  *DeviceRegistry
+	auth *Authenticator
 	cli  HydroponicClient
 	repo HydroponicRepo
 	t    TimeLoader
+	ph   *PhController
+	ls   *LightScheduler
+	ing  *Ingestor
+	sc   *SensorCache
+	hub  *EventHub
+	al   *AlertEngine
+	cmds *CommandLog
+	out  *Outbox
+	sh   *Shadow
+	met  *Metrics
+
+	certs    *certReloader
+	stopping chan struct{}
+	stopOnce sync.Once
 }
 
 // AppConfig structure containing the server settings necessary for its operation.
+// The server uses HTTPS when TLSCertFile and TLSKeyFile are set, with TLSReloadInterval the
+// certificate is reloaded when the files change. The forwarding headers are only honoured for requests
+// from TrustedProxies, addresses or CIDR ranges. MetricsPublic serves /metrics without credentials.
 type AppConfig struct {
-	NetInterface string
-	Timeout      time.Duration
+	NetInterface      string
+	Timeout           time.Duration
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+	TrustedProxies    []string
+	MetricsPublic     bool
 }
 
-func (ac *AppConfig) checkConfig() {
+func (ac *AppConfig) checkConfig() error {
 	log.Debug().Msg("checking api application config")
 
 	if ac.NetInterface == "" {
@@ -40,16 +77,168 @@ func (ac *AppConfig) checkConfig() {
 	if ac.Timeout <= 0 {
 		ac.Timeout = 10 * time.Millisecond
 	}
+	if (ac.TLSCertFile == "") != (ac.TLSKeyFile == "") {
+		return errors.New("api certificate and key must be set together")
+	}
+	return nil
 }
 
 // SearchRequest is strust for storage and validate query param.
+// Fields is read by bind, echo only binds the first of the repeated params.
 type SearchRequest struct {
-	Start time.Time `validate:"required" query:"s"`
-	End   time.Time `validate:"required" query:"e"`
+	Start  *QueryTime    `validate:"required" query:"s"`
+	End    *QueryTime    `validate:"required" query:"e"`
+	Window QueryDuration `query:"w"`
+	Fn     AggregateFn   `validate:"omitempty,oneof=mean min max last median" query:"fn"`
+	Fields QueryFields   `query:"-"`
+	Events bool          `query:"events"`
+}
+
+// bind reads the query params of the request.
+func (r *SearchRequest) bind(c echo.Context) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	fields, err := parseQueryFields(c.QueryParams()["fields"])
+	if err != nil {
+		return err
+	}
+	r.Fields = fields
+	return nil
+}
+
+// DataResponse is returned instead of the bare data when the commands are requested with events=true.
+type DataResponse struct {
+	Data   interface{}         `json:"data"`
+	Events []CommandAnnotation `json:"events"`
+}
+
+// dataQuery converts the request to a repository query.
+func (r *SearchRequest) dataQuery(device string) (DataQuery, error) {
+	q := DataQuery{
+		Device: device,
+		Start:  r.Start.Time,
+		End:    r.End.Time,
+		Window: time.Duration(r.Window),
+		Fn:     r.Fn,
+		Fields: r.Fields,
+	}
+	if q.Start.After(q.End) {
+		return q, errors.New("start must not be after end")
+	}
+	if q.Window < 0 || (q.Window > 0 && q.Window < time.Second) || (q.Window == 0 && q.Fn != "") {
+		return q, errors.New("window must be at least 1s and is required by fn")
+	}
+	return q, nil
+}
+
+// ErrorsRequest is struct for storage and validate the device errors query params.
+type ErrorsRequest struct {
+	Start  *QueryTime `query:"s"`
+	End    *QueryTime `query:"e"`
+	Limit  int        `validate:"min=0,max=1000" query:"limit"`
+	Offset int        `validate:"min=0" query:"offset"`
+}
+
+// ErrorsPage is a page of device errors, newest first.
+type ErrorsPage struct {
+	Errors []DeviceError `json:"errors"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+}
+
+// CommandsRequest is struct for storage and validate the command history query params.
+type CommandsRequest struct {
+	Start   *QueryTime     `query:"s"`
+	End     *QueryTime     `query:"e"`
+	Device  string         `query:"device"`
+	Command string         `validate:"omitempty,oneof=ph_up ph_down light_change soil add_water light_on light_off" query:"command"`
+	Caller  string         `query:"caller"`
+	Outcome CommandOutcome `validate:"omitempty,oneof=acknowledged rejected ack_timeout publish_timeout failed queued expired" query:"outcome"`
+	Limit   int            `validate:"min=0,max=1000" query:"limit"`
+	Offset  int            `validate:"min=0" query:"offset"`
+}
+
+// CommandsPage is a page of command records, newest first.
+type CommandsPage struct {
+	Commands []CommandResult `json:"commands"`
+	Limit    int             `json:"limit"`
+	Offset   int             `json:"offset"`
+}
+
+// QueryTime is a RFC3339 time bound from a query param.
+type QueryTime struct {
+	time.Time
+}
+
+// UnmarshalParam implements echo.BindUnmarshaler.
+func (t *QueryTime) UnmarshalParam(param string) error {
+	v, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return err
+	}
+	t.Time = v
+	return nil
+}
+
+// QueryFields is a list of sensor fields from repeated or comma separated query params.
+type QueryFields []SensorField
+
+// parseQueryFields reads the fields of the params, empty names are skipped.
+func parseQueryFields(params []string) (QueryFields, error) {
+	var fields QueryFields
+	for _, param := range params {
+		for _, name := range strings.Split(param, ",") {
+			if strings.TrimSpace(name) == "" {
+				continue
+			}
+			field, err := ParseSensorField(name)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// QueryDuration is a duration like "5m" bound from a query param.
+type QueryDuration time.Duration
+
+// UnmarshalParam implements echo.BindUnmarshaler.
+func (d *QueryDuration) UnmarshalParam(param string) error {
+	v, err := time.ParseDuration(param)
+	if err != nil {
+		return err
+	}
+	*d = QueryDuration(v)
+	return nil
+}
+
+// DoseRequest sets the volume or the pump run time of a dose, without them the controller default dose is used.
+type DoseRequest struct {
+	CommandParams
+}
+
+func (r DoseRequest) params() CommandParams {
+	return r.CommandParams
 }
 
 type ChangePhRequest struct {
 	IsUp bool `json:"up"`
+	DoseRequest
+}
+
+// PhControlRequest switches the automatic pH control loop.
+type PhControlRequest struct {
+	Enabled *bool `json:"enabled" validate:"required"`
+}
+
+// ChangeLightRequest sets the light to the On state, without it the light is toggled.
+// Intensity in percent is only accepted when switching the light on.
+type ChangeLightRequest struct {
+	On        *bool  `json:"on"`
+	Intensity *uint8 `json:"intensity" validate:"omitempty,min=1,max=100"`
 }
 
 type TimeLoadResponse struct {
@@ -71,45 +260,110 @@ func (v *Validator) Validate(i interface{}) error {
 }
 
 // NewApp returns a new ready-to-launch API object with adjusted settings.
-func NewApp(ctx context.Context, appCfg AppConfig, hc HydroponicClient, hr HydroponicRepo, t TimeLoader) (*API, error) {
-	appCfg.checkConfig()
+func NewApp(ctx context.Context, appCfg AppConfig, auth *Authenticator, reg *DeviceRegistry, hc HydroponicClient, hr HydroponicRepo, t TimeLoader, pc *PhController, ls *LightScheduler, ing *Ingestor, sc *SensorCache, hub *EventHub, al *AlertEngine, cmds *CommandLog, out *Outbox, sh *Shadow, met *Metrics) (*API, error) {
+	if err := appCfg.checkConfig(); err != nil {
+		return nil, err
+	}
 
 	log.Debug().Interface("api app config", appCfg).Msg("starting initialize api application")
 
+	proxies, err := parseTrustedProxies(appCfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
 	e := echo.New()
 	e.HideBanner = true
 
 	a := &API{
 		e:    e,
 		addr: appCfg.NetInterface,
+		reg:  reg,
+		auth: auth,
 		cli:  hc,
 		repo: hr,
 		t:    t,
+		ph:   pc,
+		ls:   ls,
+		ing:  ing,
+		sc:   sc,
+		hub:  hub,
+		al:   al,
+		cmds: cmds,
+		out:  out,
+		sh:   sh,
+		met:  met,
+
+		stopping: make(chan struct{}),
+	}
+	if appCfg.TLSCertFile != "" {
+		certs, err := newCertReloader(appCfg.TLSCertFile, appCfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.certs = certs
+		if appCfg.TLSReloadInterval > 0 {
+			go certs.watch(ctx, appCfg.TLSReloadInterval)
+		}
 	}
 
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			cc := &Context{
-				Context: c,
-				Ctx:     ctx,
+				Context:  c,
+				Ctx:      ctx,
+				RemoteIP: proxies.clientIP(c.Request()),
 			}
 			return next(cc)
 		}
 	})
+	e.Use(queryToken("/api/events", "/api/devices/:device/events"))
 	e.Validator = &Validator{validator: validator.New()}
+	e.Use(requestIDMiddleware)
+	e.Use(traceMiddleware)
 	e.Use(logMiddleware)
 
 	e.GET("/healthcheck", a.handleHealthcheck)
 
-	g := e.Group("/api")
-	g.GET("/light", a.handleLightState)
-	g.GET("/data", a.handleSearch)
-	g.GET("/time", a.handleLoadTime)
-	g.POST("/time", a.handleStoreTime)
-	g.POST("/light", a.handleChangeLight)
-	g.POST("/ph", a.handleChangePh)
-	g.POST("/soil", a.handleAddSoil)
-	g.POST("/water", a.handleAddWater)
+	viewer, operator, admin := requireRole(RoleViewer), requireRole(RoleOperator), requireRole(RoleAdmin)
+
+	// the metrics expose the device ids and readings, they need a viewer unless made public
+	if appCfg.MetricsPublic {
+		e.GET("/metrics", echo.WrapHandler(met.Handler()))
+	} else {
+		e.GET("/metrics", echo.WrapHandler(met.Handler()), auth.middleware, viewer)
+	}
+
+	g := e.Group("/api", auth.middleware)
+	g.GET("/time", a.handleLoadTime, viewer)
+	g.POST("/time", a.handleStoreTime, admin)
+	g.GET("/devices", a.handleDevices, viewer)
+	g.GET("/events", a.handleEvents, viewer)
+	g.GET("/commands", a.handleCommands, viewer)
+	g.GET("/outbox", a.handleOutbox, viewer)
+	g.GET("/state", a.handleState, viewer)
+	g.DELETE("/outbox/:id", a.handleCancelQueued, operator)
+
+	d := g.Group("/devices/:device", a.deviceMiddleware)
+	d.GET("", a.handleDevice, viewer)
+	d.GET("/light", a.handleLightState, viewer)
+	d.GET("/light/schedule", a.handleLightSchedule, viewer)
+	d.GET("/state", a.handleDeviceState, viewer)
+	d.GET("/data", a.handleSearch, viewer)
+	d.GET("/data/:field", a.handleSeries, viewer)
+	d.GET("/sensors/latest", a.handleLatest, viewer)
+	d.GET("/events", a.handleEvents, viewer)
+	d.GET("/alerts", a.handleAlerts, viewer)
+	d.GET("/errors", a.handleDeviceErrors, viewer)
+	d.GET("/commands", a.handleCommands, viewer)
+	d.GET("/outbox", a.handleOutbox, viewer)
+	d.POST("/alerts/:name/ack", a.handleAckAlert, operator)
+	d.POST("/light", a.handleChangeLight, operator)
+	d.POST("/ph", a.handleChangePh, operator)
+	d.GET("/ph/control", a.handlePhControlState, viewer)
+	d.POST("/ph/control", a.handleSwitchPhControl, operator)
+	d.POST("/soil", a.handleAddSoil, operator)
+	d.POST("/water", a.handleAddWater, operator)
 
 	log.Debug().Msg("endpoints registered")
 
@@ -120,6 +374,31 @@ func (a *API) handleHealthcheck(c echo.Context) error {
 	return ok(c)
 }
 
+// deviceMiddleware rejects requests for devices that are not registered.
+func (a *API) deviceMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !a.reg.Has(c.Param("device")) {
+			log.Debug().Str("device", c.Param("device")).Msg("unknown device requested")
+			return echo.NewHTTPError(http.StatusNotFound, ErrUnknownDevice.Error())
+		}
+		return next(c)
+	}
+}
+
+func (a *API) handleDevices(c echo.Context) error {
+	log.Debug().Msg("handleDevices run")
+	return c.JSON(http.StatusOK, a.reg.Devices())
+}
+
+func (a *API) handleDevice(c echo.Context) error {
+	log.Debug().Str("device", c.Param("device")).Msg("handleDevice run")
+	d, err := a.reg.Device(c.Param("device"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return c.JSON(http.StatusOK, d)
+}
+
 func (a *API) handleLoadTime(c echo.Context) error {
 	st, err := a.t.GetStartupTime()
 	if err != nil {
@@ -159,61 +438,332 @@ func (a *API) handleSearch(c echo.Context) error {
 	var err error
 
 	request := &SearchRequest{}
-	if err := c.Bind(request); err != nil {
+	if err := request.bind(c); err != nil {
 		log.Debug().Err(err).Msg("handleSearch Bind err")
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
 
+	if err = c.Validate(request); err != nil {
+		log.Debug().Err(err).Msg("handleSearch Validate err")
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	q, err := request.dataQuery(c.Param("device"))
+	if err != nil {
+		log.Debug().Err(err).Msg("handleSearch invalid query")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
 	log.Debug().
-		Time("start", request.Start).
-		Time("end", request.End).
+		Str("device", q.Device).
+		Time("start", q.Start).
+		Time("end", q.End).
+		Dur("window", q.Window).
+		Str("fn", string(q.Fn)).
+		Interface("fields", q.Fields).
+		Bool("events", request.Events).
 		Msg("handleSearch run")
 
+	r, err := a.repo.GetLastData(requestContext(c), q)
+
+	if err != nil {
+		log.Err(err).Msg("can not get data from influxdb")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return a.dataResponse(c, request, q, r)
+}
+
+// dataResponse adds the command annotations of the queried range when they were requested.
+func (a *API) dataResponse(c echo.Context, request *SearchRequest, q DataQuery, data interface{}) error {
+	if !request.Events {
+		return c.JSON(http.StatusOK, data)
+	}
+	events, err := a.repo.GetCommandAnnotations(requestContext(c), q)
+	if err != nil {
+		log.Err(err).Msg("can not get command annotations from influxdb")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, &DataResponse{Data: data, Events: events})
+}
+
+func (a *API) handleSeries(c echo.Context) error {
+	field, err := ParseSensorField(c.Param("field"))
+	if err != nil {
+		log.Debug().Err(err).Msg("handleSeries unknown field")
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	request := &SearchRequest{}
+	if err := request.bind(c); err != nil {
+		log.Debug().Err(err).Msg("handleSeries Bind err")
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
 	if err = c.Validate(request); err != nil {
-		log.Debug().Err(err).Msg("handleSearch Validate err")
+		log.Debug().Err(err).Msg("handleSeries Validate err")
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
-	var ctx context.Context
-	cc, b := c.(Context)
-	if !b {
-		log.Warn().Msg("incorrect context, use common")
-		ctx = context.Background()
-	} else {
-		ctx = cc.Ctx
+
+	q, err := request.dataQuery(c.Param("device"))
+	if err != nil {
+		log.Debug().Err(err).Msg("handleSeries invalid query")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
-	r, err := a.repo.GetLastData(ctx, request.Start, request.End)
 
+	log.Debug().
+		Str("device", q.Device).
+		Str("field", string(field)).
+		Time("start", q.Start).
+		Time("end", q.End).
+		Msg("handleSeries run")
+
+	r, err := a.repo.GetSeries(requestContext(c), q, field)
 	if err != nil {
-		log.Err(err).Msg("can not get data from influxdb")
+		log.Err(err).Msg("can not get series from influxdb")
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	return c.JSON(http.StatusOK, r)
+	return a.dataResponse(c, request, q, r)
+}
+
+func (a *API) handleLatest(c echo.Context) error {
+	log.Debug().Msg("handleLatest run")
+	return c.JSON(http.StatusOK, a.sc.Latest(c.Param("device")))
+}
+
+// handleEvents streams the hub events as Server-Sent Events until the client disconnects,
+// outside of a device route the events of every device are streamed.
+func (a *API) handleEvents(c echo.Context) error {
+	log.Debug().Str("device", c.Param("device")).Msg("handleEvents run")
+	events, unsubscribe := a.hub.Subscribe(c.Param("device"))
+	defer unsubscribe()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	done := c.Request().Context().Done()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-a.stopping:
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Error().Err(err).Msg("can not marshal event")
+				continue
+			}
+			if _, err = fmt.Fprintf(res, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
+
+func (a *API) handleAlerts(c echo.Context) error {
+	log.Debug().Msg("handleAlerts run")
+	return c.JSON(http.StatusOK, a.al.Alerts(c.Param("device")))
+}
+
+func (a *API) handleAckAlert(c echo.Context) error {
+	log.Debug().Str("name", c.Param("name")).Msg("handleAckAlert run")
+	st, err := a.al.Acknowledge(c.Param("device"), c.Param("name"), time.Now())
+	switch {
+	case errors.Is(err, ErrUnknownAlert):
+		return echo.NewHTTPError(http.StatusNotFound)
+	case errors.Is(err, ErrAlertNotFiring):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return c.JSON(http.StatusOK, st)
+}
+
+func (a *API) handleDeviceErrors(c echo.Context) error {
+	request := &ErrorsRequest{}
+	if err := c.Bind(request); err != nil {
+		log.Debug().Err(err).Msg("handleDeviceErrors Bind err")
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	if err := c.Validate(request); err != nil {
+		log.Debug().Err(err).Msg("handleDeviceErrors Validate err")
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	now := time.Now()
+	q := ErrorQuery{
+		Device: c.Param("device"),
+		Start:  now.Add(-24 * time.Hour),
+		End:    now,
+		Limit:  request.Limit,
+		Offset: request.Offset,
+	}
+	if request.Start != nil {
+		q.Start = request.Start.Time
+	}
+	if request.End != nil {
+		q.End = request.End.Time
+	}
+	if q.Limit == 0 {
+		q.Limit = 100
+	}
+
+	log.Debug().
+		Str("device", q.Device).
+		Time("start", q.Start).
+		Time("end", q.End).
+		Int("limit", q.Limit).
+		Int("offset", q.Offset).
+		Msg("handleDeviceErrors run")
+
+	errs, err := a.repo.GetDeviceErrors(requestContext(c), q)
+	if err != nil {
+		log.Err(err).Msg("can not get device errors from influxdb")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, &ErrorsPage{Errors: errs, Limit: q.Limit, Offset: q.Offset})
+}
+
+// handleState returns the shadow of every device.
+func (a *API) handleState(c echo.Context) error {
+	log.Debug().Msg("handleState run")
+	return c.JSON(http.StatusOK, a.sh.Devices())
+}
+
+func (a *API) handleDeviceState(c echo.Context) error {
+	log.Debug().Msg("handleDeviceState run")
+	return c.JSON(http.StatusOK, a.sh.Device(c.Param("device")))
+}
+
+// handleOutbox returns the commands waiting for the broker, on a device route only those of the device.
+func (a *API) handleOutbox(c echo.Context) error {
+	log.Debug().Msg("handleOutbox run")
+	return c.JSON(http.StatusOK, a.out.State(c.Param("device")))
+}
+
+// handleCancelQueued removes a command from the outbox before it is replayed.
+func (a *API) handleCancelQueued(c echo.Context) error {
+	log.Debug().Msg("handleCancelQueued run")
+	if err := a.out.Remove(c.Param("id")); err != nil {
+		if errors.Is(err, ErrOutboxEntryNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		log.Error().Err(err).Msg("can not remove queued command")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return ok(c)
+}
+
+// handleCommands returns the audit trail, on a device route it is limited to that device.
+func (a *API) handleCommands(c echo.Context) error {
+	request := &CommandsRequest{}
+	if err := c.Bind(request); err != nil {
+		log.Debug().Err(err).Msg("handleCommands Bind err")
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	if err := c.Validate(request); err != nil {
+		log.Debug().Err(err).Msg("handleCommands Validate err")
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	now := time.Now()
+	q := CommandQuery{
+		Start:   now.Add(-24 * time.Hour),
+		End:     now,
+		Device:  request.Device,
+		Command: request.Command,
+		Caller:  request.Caller,
+		Outcome: request.Outcome,
+		Limit:   request.Limit,
+		Offset:  request.Offset,
+	}
+	if d := c.Param("device"); d != "" {
+		q.Device = d
+	}
+	if request.Start != nil {
+		q.Start = request.Start.Time
+	}
+	if request.End != nil {
+		q.End = request.End.Time
+	}
+	if q.Limit == 0 {
+		q.Limit = 100
+	}
+
+	log.Debug().
+		Str("device", q.Device).
+		Time("start", q.Start).
+		Time("end", q.End).
+		Int("limit", q.Limit).
+		Int("offset", q.Offset).
+		Msg("handleCommands run")
+
+	cmds, err := a.cmds.Query(q)
+	if err != nil {
+		log.Err(err).Msg("can not read command log")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, &CommandsPage{Commands: cmds, Limit: q.Limit, Offset: q.Offset})
 }
 
 func (a *API) handleLightState(c echo.Context) error {
 	log.Debug().Msg("handleLightState run")
-	r := a.cli.GetLightState()
+	r := a.sh.LightState(c.Param("device"))
 
 	return c.JSON(http.StatusOK, r)
 }
 
+func (a *API) handleLightSchedule(c echo.Context) error {
+	log.Debug().Msg("handleLightSchedule run")
+	return c.JSON(http.StatusOK, a.ls.State(c.Param("device"), time.Now()))
+}
+
 func (a *API) handleAddSoil(c echo.Context) error {
 	log.Debug().Msg("handleAddSoil run")
-	if err := a.cli.SendAddSoil(); err != nil {
-		log.Error().Err(err).Msg("can not send add soil command")
-		return echo.NewHTTPError(http.StatusInternalServerError)
+	request, err := bindDose(c)
+	if err != nil {
+		return err
 	}
-	return ok(c)
+	return commandResult(c, a.cli.Send(requestContext(c), c.Param("device"), SoilCommand, request.params()), "add soil")
 }
 
 func (a *API) handleAddWater(c echo.Context) error {
 	log.Debug().Msg("handleAddWater run")
-	if err := a.cli.SendAddWater(); err != nil {
-		log.Error().Err(err).Msg("can not send add water command")
-		return echo.NewHTTPError(http.StatusInternalServerError)
+	request, err := bindDose(c)
+	if err != nil {
+		return err
 	}
-	return ok(c)
+	return commandResult(c, a.cli.Send(requestContext(c), c.Param("device"), AddWaterCommand, request.params()), "add water")
+}
+
+// bindDose reads the optional dose parameters, an empty body doses the controller default.
+func bindDose(c echo.Context) (*DoseRequest, error) {
+	request := &DoseRequest{}
+	if c.Request().ContentLength == 0 {
+		return request, nil
+	}
+	if err := c.Bind(request); err != nil {
+		log.Debug().Err(err).Msg("bindDose Bind err")
+		return nil, echo.NewHTTPError(http.StatusBadRequest)
+	}
+	if err := c.Validate(request); err != nil {
+		log.Debug().Err(err).Msg("bindDose Validate err")
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return request, nil
 }
 
 func (a *API) handleChangePh(c echo.Context) error {
@@ -230,31 +780,95 @@ func (a *API) handleChangePh(c echo.Context) error {
 	}
 
 	if request.IsUp {
-		if err := a.cli.SendUpPh(); err != nil {
-			log.Error().Err(err).Msg("can not send up ph command")
-			return echo.NewHTTPError(http.StatusInternalServerError)
-		}
-	} else {
-		if err := a.cli.SendDownPh(); err != nil {
-			log.Error().Err(err).Msg("can not send down ph command")
-			return echo.NewHTTPError(http.StatusInternalServerError)
-		}
+		return commandResult(c, a.cli.Send(requestContext(c), c.Param("device"), PhUpCommand, request.params()), "up ph")
 	}
-	return ok(c)
+	return commandResult(c, a.cli.Send(requestContext(c), c.Param("device"), PhDownCommand, request.params()), "down ph")
+}
+
+func (a *API) handlePhControlState(c echo.Context) error {
+	log.Debug().Msg("handlePhControlState run")
+	return c.JSON(http.StatusOK, a.ph.State(c.Param("device"), time.Now()))
+}
+
+func (a *API) handleSwitchPhControl(c echo.Context) error {
+	log.Debug().Msg("handleSwitchPhControl run")
+	request := &PhControlRequest{}
+	if err := c.Bind(request); err != nil {
+		log.Debug().Err(err).Msg("handleSwitchPhControl Bind err")
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	if err := c.Validate(request); err != nil {
+		log.Debug().Err(err).Msg("handleSwitchPhControl Validate err")
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	a.ph.SetEnabled(c.Param("device"), *request.Enabled)
+	return c.JSON(http.StatusOK, a.ph.State(c.Param("device"), time.Now()))
 }
 
 func (a *API) handleChangeLight(c echo.Context) error {
 	log.Debug().Msg("handleChangeLight run")
-	if err := a.cli.SendChangeLight(); err != nil {
-		log.Error().Err(err).Msg("can not send change light command")
-		return echo.NewHTTPError(http.StatusInternalServerError)
+	request := &ChangeLightRequest{}
+	// an empty body keeps the legacy toggle behaviour
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(request); err != nil {
+			log.Debug().Err(err).Msg("handleChangeLight Bind err")
+			return echo.NewHTTPError(http.StatusBadRequest)
+		}
 	}
-	return ok(c)
+
+	if err := c.Validate(request); err != nil {
+		log.Debug().Err(err).Msg("handleChangeLight Validate err")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if request.Intensity != nil && (request.On == nil || !*request.On) {
+		return echo.NewHTTPError(http.StatusBadRequest, "intensity is only accepted when switching the light on")
+	}
+
+	if request.On == nil {
+		return commandResult(c, a.cli.SendChangeLight(requestContext(c), c.Param("device")), "change light")
+	}
+	if request.Intensity != nil {
+		p := CommandParams{Intensity: request.Intensity}
+		return commandResult(c, a.cli.Send(requestContext(c), c.Param("device"), LightOnCommand, p), "set light")
+	}
+	return commandResult(c, a.cli.SetLight(requestContext(c), c.Param("device"), *request.On), "set light")
 }
 
-// Run start the server.
+// Run start the server, it returns nil after Shutdown.
 func (a *API) Run() error {
-	return a.e.Start(a.addr)
+	var err error
+	if a.certs == nil {
+		err = a.e.Start(a.addr)
+	} else {
+		s := a.e.TLSServer
+		s.Addr = a.addr
+		s.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: a.certs.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+		err = a.e.StartServer(s)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests, ends the event streams and waits for the in-flight requests
+// and the commands still waiting for an acknowledgement.
+func (a *API) Shutdown(ctx context.Context) error {
+	log.Info().Msg("shutting down server gracefully")
+	a.stopOnce.Do(func() { close(a.stopping) })
+	if err := a.e.Shutdown(ctx); err != nil {
+		return err
+	}
+	if d, ok := a.cli.(Drainer); ok {
+		return d.Drain(ctx)
+	}
+	return nil
 }
 
 // Close stop the server.
@@ -271,6 +885,77 @@ func ok(c echo.Context) error {
 	return c.JSON(http.StatusOK, &SimpleMessage{http.StatusOK})
 }
 
+// requestContext returns the application context attached by the context middleware,
+// carrying the origin of the request and its span.
+func requestContext(c echo.Context) context.Context {
+	origin := CommandOrigin{
+		Caller:     principal(c).Name,
+		RemoteAddr: remoteIP(c),
+		RequestID:  c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	cc, b := c.(*Context)
+	if !b {
+		log.Warn().Msg("incorrect context, use common")
+		return WithCommandOrigin(context.Background(), origin)
+	}
+	ctx := trace.ContextWithSpan(cc.Ctx, trace.SpanFromContext(c.Request().Context()))
+	return WithCommandOrigin(ctx, origin)
+}
+
+// requestIDMiddleware keeps the X-Request-ID of the caller or assigns a new one, and returns it in the response.
+func requestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(echo.HeaderXRequestID)
+		if id == "" || len(id) > 128 {
+			id = newCorrelationID()
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+		return next(c)
+	}
+}
+
+// commandResult maps the outcome of a command to the response status:
+// 200 when the controller acknowledged it, 202 when the broker accepted it but no ack arrived in time
+// or when it was queued in the outbox,
+// 504 when the broker did not confirm the publish, 502 when the controller reported an error
+// 400 for parameters the command does not take, 503 once the server is shutting down, 429 when a safety limit is reached and 409 when an interlock refused it.
+func commandResult(c echo.Context, err error, name string) error {
+	var cmdErr *CommandError
+	var safetyErr *SafetyError
+	switch {
+	case err == nil:
+		return ok(c)
+	case errors.As(err, &safetyErr) && errors.Is(err, ErrRateLimited):
+		if safetyErr.RetryAfter > 0 {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(safetyErr.RetryAfter.Seconds()))))
+		}
+		return echo.NewHTTPError(http.StatusTooManyRequests, safetyErr.Reason)
+	case errors.As(err, &safetyErr):
+		return echo.NewHTTPError(http.StatusConflict, safetyErr.Reason)
+	case errors.Is(err, ErrInvalidParams):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrUnknownDevice):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrClientClosing):
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, ErrCommandQueued):
+		log.Warn().Err(err).Msgf("%s command queued in the outbox", name)
+		return c.JSON(http.StatusAccepted, &SimpleMessage{http.StatusAccepted})
+	case errors.Is(err, ErrAckTimeout):
+		log.Warn().Err(err).Msgf("%s command was not acknowledged", name)
+		return c.JSON(http.StatusAccepted, &SimpleMessage{http.StatusAccepted})
+	case errors.Is(err, ErrPublishTimeout):
+		log.Error().Err(err).Msgf("can not send %s command", name)
+		return echo.NewHTTPError(http.StatusGatewayTimeout)
+	case errors.As(err, &cmdErr):
+		log.Error().Err(err).Msgf("%s command failed on controller", name)
+		return echo.NewHTTPError(http.StatusBadGateway, cmdErr.Err)
+	default:
+		log.Error().Err(err).Msgf("can not send %s command", name)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
 func logMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		req := c.Request()
@@ -283,6 +968,9 @@ func logMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 
 		log.Debug().
 			Str("remote", req.RemoteAddr).
+			Str("caller", principal(c).Name).
+			Str("request_id", res.Header().Get(echo.HeaderXRequestID)).
+			Str("trace_id", trace.SpanContextFromContext(req.Context()).TraceID().String()).
 			Str("user_agent", req.UserAgent()).
 			Str("method", req.Method).
 			Str("path", c.Path()).
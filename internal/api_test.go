@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRepo records the queries instead of running them.
+type fakeRepo struct {
+	HydroponicRepo
+
+	mu     sync.Mutex
+	q      *DataQuery
+	field  SensorField
+	latest map[string]LatestReadings
+}
+
+func (f *fakeRepo) GetLatest(_ context.Context, device string) (LatestReadings, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, ok := f.latest[device]
+	if !ok {
+		return l, errors.New("influxdb is unreachable")
+	}
+	return l, nil
+}
+
+func (f *fakeRepo) setLatest(device string, l LatestReadings) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.latest == nil {
+		f.latest = make(map[string]LatestReadings)
+	}
+	f.latest[device] = l
+}
+
+func (f *fakeRepo) GetLastData(_ context.Context, q DataQuery) ([]SensorData, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.q = &q
+	return []SensorData{}, nil
+}
+
+func (f *fakeRepo) GetSeries(_ context.Context, q DataQuery, field SensorField) ([]SeriesPoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.q, f.field = &q, field
+	return []SeriesPoint{}, nil
+}
+
+func (f *fakeRepo) query() *DataQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := f.q
+	f.q = nil
+	return q
+}
+
+// newTestAPI returns the application without authentication on a single device.
+func newTestAPI(t *testing.T, repo HydroponicRepo) *API {
+	t.Helper()
+	auth, err := NewAuthenticator(&AuthConfig{Disabled: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reg, err := NewDeviceRegistry(&DeviceConfig{Devices: []string{"tank-1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a, err := NewApp(context.Background(), AppConfig{}, auth, reg,
+		nil, repo, nil, nil, nil, nil, nil, NewEventHub(&fakeTelemetry{}), nil, nil, nil, nil, NewMetrics(&fakeTelemetry{}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return a
+}
+
+func TestSearchValidation(t *testing.T) {
+	repo := &fakeRepo{}
+	a := newTestAPI(t, repo)
+	const rng = "s=2023-05-01T00:00:00Z&e=2023-05-02T00:00:00Z"
+	for _, tc := range []struct {
+		name   string
+		query  string
+		status int
+		window time.Duration
+		fn     AggregateFn
+	}{
+		{"raw data", rng, http.StatusOK, 0, ""},
+		{"window", rng + "&w=5m", http.StatusOK, 5 * time.Minute, ""},
+		{"window and fn", rng + "&w=1h&fn=max", http.StatusOK, time.Hour, AggregateMax},
+		{"start missing", "e=2023-05-02T00:00:00Z", http.StatusBadRequest, 0, ""},
+		{"invalid start", "s=yesterday&e=2023-05-02T00:00:00Z", http.StatusBadRequest, 0, ""},
+		{"start after end", "s=2023-05-02T00:00:00Z&e=2023-05-01T00:00:00Z", http.StatusBadRequest, 0, ""},
+		{"empty range", "s=2023-05-01T00:00:00Z&e=2023-05-01T00:00:00Z", http.StatusOK, 0, ""},
+		{"window under 1s", rng + "&w=500ms", http.StatusBadRequest, 0, ""},
+		{"negative window", rng + "&w=-1m", http.StatusBadRequest, 0, ""},
+		{"invalid window", rng + "&w=often", http.StatusBadRequest, 0, ""},
+		{"fn without window", rng + "&fn=mean", http.StatusBadRequest, 0, ""},
+		{"unknown fn", rng + "&w=5m&fn=sum", http.StatusBadRequest, 0, ""},
+	} {
+		for _, path := range []string{"/api/devices/tank-1/data", "/api/devices/tank-1/data/ph"} {
+			rec := httptest.NewRecorder()
+			a.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?"+tc.query, nil))
+			if rec.Code != tc.status {
+				t.Errorf("%s %s: status %d, want %d", tc.name, path, rec.Code, tc.status)
+				continue
+			}
+			q := repo.query()
+			if tc.status != http.StatusOK {
+				if q != nil {
+					t.Errorf("%s %s: invalid request queried %+v", tc.name, path, q)
+				}
+				continue
+			}
+			if q == nil || q.Device != "tank-1" || q.Window != tc.window || q.Fn != tc.fn {
+				t.Errorf("%s %s: queried %+v", tc.name, path, q)
+			}
+		}
+	}
+}
+
+func TestSearchFields(t *testing.T) {
+	repo := &fakeRepo{}
+	a := newTestAPI(t, repo)
+	const rng = "s=2023-05-01T00:00:00Z&e=2023-05-02T00:00:00Z"
+	for _, tc := range []struct {
+		query  string
+		status int
+		fields []SensorField
+	}{
+		{"", http.StatusOK, nil},
+		{"&fields=", http.StatusOK, nil},
+		{"&fields=ph", http.StatusOK, []SensorField{FieldPH}},
+		{"&fields=ph,lvl", http.StatusOK, []SensorField{FieldPH, FieldMinWaterLevel}},
+		{"&fields=ph&fields=lvl", http.StatusOK, []SensorField{FieldPH, FieldMinWaterLevel}},
+		{"&fields=ph,soil&fields=&fields=minWaterLevel", http.StatusOK, []SensorField{FieldPH, FieldSoilMoisture, FieldMinWaterLevel}},
+		{"&fields=PH", http.StatusOK, []SensorField{FieldPH}},
+		{"&fields=ph&fields=bogus", http.StatusBadRequest, nil},
+	} {
+		rec := httptest.NewRecorder()
+		a.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/devices/tank-1/data?"+rng+tc.query, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%q: status %d, want %d", tc.query, rec.Code, tc.status)
+			continue
+		}
+		q := repo.query()
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if q == nil || len(q.Fields) != len(tc.fields) {
+			t.Errorf("%q: queried %+v, want fields %v", tc.query, q, tc.fields)
+			continue
+		}
+		for i := range tc.fields {
+			if q.Fields[i] != tc.fields[i] {
+				t.Errorf("%q: fields %v, want %v", tc.query, q.Fields, tc.fields)
+				break
+			}
+		}
+	}
+
+	// the series is the field of the path whatever the fields param
+	rec := httptest.NewRecorder()
+	a.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/devices/tank-1/data/soil?"+rng+"&fields=ph", nil))
+	if rec.Code != http.StatusOK || repo.field != FieldSoilMoisture {
+		t.Errorf("series: status %d field %q", rec.Code, repo.field)
+	}
+}
+
+// blockingClient holds the commands and the drain until they are released.
+type blockingClient struct {
+	fakeClient
+	sending      chan struct{}
+	releaseSend  chan struct{}
+	draining     chan struct{}
+	releaseDrain chan struct{}
+}
+
+func (b *blockingClient) Send(ctx context.Context, device string, cmd Command, p CommandParams) error {
+	close(b.sending)
+	<-b.releaseSend
+	return b.fakeClient.Send(ctx, device, cmd, p)
+}
+
+func (b *blockingClient) Drain(context.Context) error {
+	close(b.draining)
+	<-b.releaseDrain
+	return nil
+}
+
+func TestShutdownWaits(t *testing.T) {
+	cli := &blockingClient{
+		sending:      make(chan struct{}),
+		releaseSend:  make(chan struct{}),
+		draining:     make(chan struct{}),
+		releaseDrain: make(chan struct{}),
+	}
+	a := newTestAPI(t, &fakeRepo{})
+	a.cli = cli
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a.e.Listener = l
+	stopped := make(chan error, 1)
+	go func() { stopped <- a.Run() }()
+
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Post("http://"+l.Addr().String()+"/api/devices/tank-1/water", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	<-cli.sending
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- a.Shutdown(context.Background()) }()
+	// waiting is checked by the absence of a return, give the shutdown a moment to get through
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with a request in flight: %v", err)
+	case <-cli.draining:
+		t.Fatal("client drained with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(cli.releaseSend)
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("in-flight request got status %d, want 200", code)
+	}
+	select {
+	case <-cli.draining:
+	case <-time.After(time.Second):
+		t.Fatal("client not drained after the last request")
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the client drained: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(cli.releaseDrain)
+	if err := <-shutdown; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("server stopped with %v", err)
+	}
+}
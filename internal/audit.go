@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// CommandOrigin identifies who asked for a command.
+type CommandOrigin struct {
+	Caller     string `json:"caller,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+}
+
+type originKey struct{}
+
+// WithCommandOrigin returns a context carrying the origin of the commands sent with it.
+func WithCommandOrigin(ctx context.Context, o CommandOrigin) context.Context {
+	return context.WithValue(ctx, originKey{}, o)
+}
+
+func commandOriginFrom(ctx context.Context) CommandOrigin {
+	o, _ := ctx.Value(originKey{}).(CommandOrigin)
+	return o
+}
+
+// CommandQuery selects command records between Start and End, newest first. Empty filters match everything.
+type CommandQuery struct {
+	Start   time.Time
+	End     time.Time
+	Device  string
+	Command string
+	Caller  string
+	Outcome CommandOutcome
+	Limit   int
+	Offset  int
+}
+
+func (q CommandQuery) match(r CommandResult) bool {
+	return !r.Timestamp.Before(q.Start) && !r.Timestamp.After(q.End) &&
+		(q.Device == "" || r.Device == q.Device) &&
+		(q.Command == "" || r.Name == q.Command) &&
+		(q.Caller == "" || r.Caller == q.Caller) &&
+		(q.Outcome == "" || r.Outcome == q.Outcome)
+}
+
+// CommandLogConfig structure containing the audit trail file. Once the file grows over MaxSize bytes
+// it is rotated, MaxFiles rotated files are kept as File.1 (newest) to File.N.
+type CommandLogConfig struct {
+	File     string
+	MaxSize  int64
+	MaxFiles int
+}
+
+func (cc *CommandLogConfig) checkConfig() error {
+	log.Debug().Msg("checking command log config")
+
+	if cc.File == "" {
+		return errors.New("command log file is not configured")
+	}
+	if cc.MaxSize <= 0 {
+		cc.MaxSize = 10 << 20
+	}
+	if cc.MaxFiles <= 0 {
+		cc.MaxFiles = 5
+	}
+	return nil
+}
+
+// commandLogRotateBackoff is the wait before a failed rotation is tried again.
+const commandLogRotateBackoff = time.Minute
+
+// CommandLog is the audit trail of the commands sent to the controllers, stored as JSON lines.
+type CommandLog struct {
+	// mu serializes the writers, rot keeps the files from being renamed while a query opens them
+	mu       sync.Mutex
+	rot      sync.RWMutex
+	path     string
+	f        *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+	// rotateAfter delays the next rotation after a failed one
+	rotateAfter time.Time
+	openFile    func(path string) (*os.File, int64, error)
+}
+
+// NewCommandLog opens the audit trail and records every command result of the source.
+func NewCommandLog(cfg *CommandLogConfig, src TelemetrySource) (*CommandLog, func(), error) {
+	c := *cfg
+	if err := c.checkConfig(); err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.File), 0o755); err != nil {
+		return nil, nil, errors.Wrap(err, "can not create command log directory")
+	}
+	f, size, err := openCommandLog(c.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	l := &CommandLog{path: c.File, f: f, size: size, maxSize: c.MaxSize, maxFiles: c.MaxFiles, openFile: openCommandLog}
+	src.OnCommandResult(l.record)
+	return l, l.Close, nil
+}
+
+func openCommandLog(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "can not open command log")
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, errors.Wrap(err, "can not stat command log")
+	}
+	return f, st.Size(), nil
+}
+
+func (l *CommandLog) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+func (l *CommandLog) record(r CommandResult) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Error().Err(err).Str("id", r.ID).Msg("can not marshal command record")
+		return
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); l.size > 0 && l.size+int64(len(b)) > l.maxSize && !now.Before(l.rotateAfter) {
+		if err := l.rotate(); err != nil {
+			log.Error().Err(err).Dur("retry in", commandLogRotateBackoff).Msg("can not rotate command log")
+			l.rotateAfter = now.Add(commandLogRotateBackoff)
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("id", r.ID).Msg("can not write command record")
+	}
+}
+
+// rotate shifts the rotated files, dropping the oldest, and starts a new file. The new file is opened
+// before anything is renamed and the current file is put back when the new one can not take its place,
+// so a failed rotation leaves the records where they were.
+func (l *CommandLog) rotate() error {
+	l.rot.Lock()
+	defer l.rot.Unlock()
+	next := l.path + ".next"
+	f, size, err := l.openFile(next)
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		f.Close()
+		os.Remove(next)
+		return err
+	}
+	if err := os.Remove(l.rotated(l.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return abort(errors.Wrap(err, "can not remove oldest command log"))
+	}
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return abort(errors.Wrap(err, "can not rename command log"))
+		}
+	}
+	if err := os.Rename(l.path, l.rotated(1)); err != nil {
+		return abort(errors.Wrap(err, "can not rename command log"))
+	}
+	if err := os.Rename(next, l.path); err != nil {
+		if rerr := os.Rename(l.rotated(1), l.path); rerr != nil {
+			log.Error().Err(rerr).Msg("can not restore command log")
+		}
+		return abort(errors.Wrap(err, "can not rename command log"))
+	}
+	if err := l.f.Close(); err != nil {
+		log.Warn().Err(err).Msg("can not close rotated command log")
+	}
+	l.f, l.size = f, size
+	log.Info().Str("file", l.rotated(1)).Msg("command log rotated")
+	return nil
+}
+
+// open returns the current and the rotated files, oldest first.
+func (l *CommandLog) open() ([]*os.File, error) {
+	l.rot.RLock()
+	defer l.rot.RUnlock()
+	var files []*os.File
+	for i := l.maxFiles; i >= 0; i-- {
+		path := l.path
+		if i > 0 {
+			path = l.rotated(i)
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) && i > 0 {
+			continue
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, errors.Wrap(err, "can not open command log")
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Query returns the records matching q, newest first. The files are read without blocking the writer,
+// the file is only appended to so a record being written is at most seen as a truncated last line.
+func (l *CommandLog) Query(q CommandQuery) ([]CommandResult, error) {
+	files, err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	res := make([]CommandResult, 0)
+	for _, f := range files {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			var r CommandResult
+			if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+				log.Warn().Err(err).Msg("skipping malformed command record")
+				continue
+			}
+			if q.match(r) {
+				res = append(res, r)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, errors.Wrap(err, "can not read command log")
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Timestamp.After(res[j].Timestamp) })
+	if q.Offset >= len(res) {
+		return []CommandResult{}, nil
+	}
+	res = res[q.Offset:]
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[:q.Limit]
+	}
+	return res, nil
+}
+
+func (l *CommandLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.f.Close(); err != nil {
+		log.Error().Err(err).Msg("can not close command log")
+	}
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandQueryMatch(t *testing.T) {
+	ts := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := CommandResult{Device: "tank-1", Name: "ph_up", Outcome: OutcomeAcknowledged, Timestamp: ts, CommandOrigin: CommandOrigin{Caller: "ops"}}
+	all := CommandQuery{Start: ts.Add(-time.Hour), End: ts.Add(time.Hour)}
+	for _, tc := range []struct {
+		name  string
+		q     func(q CommandQuery) CommandQuery
+		match bool
+	}{
+		{"no filter", func(q CommandQuery) CommandQuery { return q }, true},
+		{"start is inclusive", func(q CommandQuery) CommandQuery { q.Start = ts; return q }, true},
+		{"end is inclusive", func(q CommandQuery) CommandQuery { q.End = ts; return q }, true},
+		{"before the range", func(q CommandQuery) CommandQuery { q.Start = ts.Add(time.Second); return q }, false},
+		{"after the range", func(q CommandQuery) CommandQuery { q.End = ts.Add(-time.Second); return q }, false},
+		{"device", func(q CommandQuery) CommandQuery { q.Device = "tank-1"; return q }, true},
+		{"other device", func(q CommandQuery) CommandQuery { q.Device = "tank-2"; return q }, false},
+		{"command", func(q CommandQuery) CommandQuery { q.Command = "ph_up"; return q }, true},
+		{"other command", func(q CommandQuery) CommandQuery { q.Command = "ph_down"; return q }, false},
+		{"caller", func(q CommandQuery) CommandQuery { q.Caller = "ops"; return q }, true},
+		{"other caller", func(q CommandQuery) CommandQuery { q.Caller = "ci"; return q }, false},
+		{"outcome", func(q CommandQuery) CommandQuery { q.Outcome = OutcomeAcknowledged; return q }, true},
+		{"other outcome", func(q CommandQuery) CommandQuery { q.Outcome = OutcomeRejected; return q }, false},
+	} {
+		if got := tc.q(all).match(r); got != tc.match {
+			t.Errorf("%s: match %v, want %v", tc.name, got, tc.match)
+		}
+	}
+}
+
+func newTestCommandLog(t *testing.T, cfg CommandLogConfig) *CommandLog {
+	t.Helper()
+	l, closeLog, err := NewCommandLog(&cfg, &fakeTelemetry{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(closeLog)
+	return l
+}
+
+func TestCommandLogPaging(t *testing.T) {
+	l := newTestCommandLog(t, CommandLogConfig{File: filepath.Join(t.TempDir(), "commands.jsonl")})
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		l.record(CommandResult{ID: string(rune('a' + i)), Device: "tank-1", Timestamp: start.Add(time.Duration(i) * time.Minute)})
+	}
+	q := CommandQuery{Start: start, End: start.Add(time.Hour)}
+
+	for _, tc := range []struct {
+		offset, limit int
+		ids           string
+	}{
+		{0, 0, "edcba"},
+		{0, 2, "ed"},
+		{2, 2, "cb"},
+		{4, 2, "a"},
+		{5, 2, ""},
+		{9, 0, ""},
+	} {
+		q.Offset, q.Limit = tc.offset, tc.limit
+		res, err := l.Query(q)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ids := ""
+		for _, r := range res {
+			ids += r.ID
+		}
+		if ids != tc.ids {
+			t.Errorf("offset %d limit %d: got %q, want %q", tc.offset, tc.limit, ids, tc.ids)
+		}
+	}
+}
+
+func TestCommandLogRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "commands.jsonl")
+	l := newTestCommandLog(t, CommandLogConfig{File: file, MaxSize: 200, MaxFiles: 2})
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		l.record(CommandResult{ID: "id", Device: "tank-1", Timestamp: start.Add(time.Duration(i) * time.Minute)})
+	}
+
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		st, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("missing %s: %v", name, err)
+		}
+		if st.Size() > 200 {
+			t.Errorf("%s has %d bytes, over the maximum size", name, st.Size())
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more rotated files than configured: %v", err)
+	}
+
+	// the query reads the rotated files, the oldest records were dropped
+	res, err := l.Query(CommandQuery{Start: start, End: start.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res) == 0 || len(res) >= 20 || !res[0].Timestamp.Equal(start.Add(19*time.Minute)) {
+		t.Fatalf("got %d records, newest %v", len(res), res)
+	}
+	for i := 1; i < len(res); i++ {
+		if res[i].Timestamp.Add(time.Minute) != res[i-1].Timestamp {
+			t.Fatalf("records are not contiguous: %v then %v", res[i-1].Timestamp, res[i].Timestamp)
+		}
+	}
+}
+
+func TestCommandLogRotationFailure(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "commands.jsonl")
+	l := newTestCommandLog(t, CommandLogConfig{File: file, MaxSize: 200, MaxFiles: 2})
+	opened := 0
+	l.openFile = func(string) (*os.File, int64, error) {
+		opened++
+		return nil, 0, errors.New("no space left on device")
+	}
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		l.record(CommandResult{ID: "id", Device: "tank-1", Timestamp: start.Add(time.Duration(i) * time.Minute)})
+	}
+	if opened != 1 {
+		t.Errorf("rotation tried %d times, want once until the backoff elapsed", opened)
+	}
+	for _, name := range []string{file + ".1", file + ".next"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s left by the failed rotation: %v", name, err)
+		}
+	}
+	// the records stay in the current file and nothing was dropped
+	res, err := l.Query(CommandQuery{Start: start, End: start.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res) != 10 {
+		t.Errorf("got %d records, want 10", len(res))
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 10 {
+		t.Errorf("current file has %d records, want 10", n)
+	}
+	// the rotation is tried again once the backoff elapsed
+	l.openFile, l.rotateAfter = openCommandLog, time.Time{}
+	l.record(CommandResult{ID: "id", Device: "tank-1", Timestamp: start.Add(10 * time.Minute)})
+	if _, err := os.Stat(file + ".1"); err != nil {
+		t.Errorf("log not rotated after the backoff: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Role grants access to the API, every role includes the permissions of the lower ones.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var roleRank = map[Role]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// ParseRole returns the role with the given name.
+func ParseRole(s string) (Role, error) {
+	r := Role(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := roleRank[r]; !ok {
+		return "", fmt.Errorf("unknown role %q", s)
+	}
+	return r, nil
+}
+
+// allows reports whether r has at least the permissions of required.
+func (r Role) allows(required Role) bool {
+	return roleRank[r] >= roleRank[required]
+}
+
+const principalKey = "principal"
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+// AuthConfig structure containing the API credentials. APIKeys are "name:role:key" entries,
+// JWTSecret enables HS256 bearer tokens carrying the role in the "role" claim. The event streams
+// also take the key or token in the access_token query param.
+type AuthConfig struct {
+	Disabled  bool
+	APIKeys   []string
+	JWTSecret string
+	JWTIssuer string
+}
+
+type apiKey struct {
+	hash      [sha256.Size]byte
+	principal Principal
+}
+
+// Authenticator checks the API key or JWT of a request.
+type Authenticator struct {
+	disabled  bool
+	keys      []apiKey
+	jwtSecret []byte
+	jwtIssuer string
+}
+
+// NewAuthenticator returns an authenticator for the configured credentials.
+func NewAuthenticator(cfg *AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{disabled: cfg.Disabled, jwtSecret: []byte(cfg.JWTSecret), jwtIssuer: cfg.JWTIssuer}
+	if a.disabled {
+		log.Warn().Msg("api authentication is disabled")
+		return a, nil
+	}
+	for _, entry := range cfg.APIKeys {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, errors.New("api key must be configured as name:role:key")
+		}
+		role, err := ParseRole(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "api key %s", parts[0])
+		}
+		a.keys = append(a.keys, apiKey{
+			hash:      sha256.Sum256([]byte(parts[2])),
+			principal: Principal{Name: parts[0], Role: role},
+		})
+	}
+	if len(a.keys) == 0 && len(a.jwtSecret) == 0 {
+		return nil, errors.New("no api keys or jwt secret configured, set AUTH_DISABLED to run without authentication")
+	}
+	log.Debug().Int("api keys", len(a.keys)).Bool("jwt", len(a.jwtSecret) > 0).Msg("api authentication initialized")
+	return a, nil
+}
+
+// authenticate returns the caller of the request from the X-API-Key header or the bearer token.
+func (a *Authenticator) authenticate(req *http.Request) (Principal, error) {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return a.checkKey(key)
+	}
+	auth := req.Header.Get(echo.HeaderAuthorization)
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return Principal{}, errors.New("missing credentials")
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if strings.Count(token, ".") == 2 && len(a.jwtSecret) > 0 {
+		return a.checkJWT(token)
+	}
+	return a.checkKey(token)
+}
+
+func (a *Authenticator) checkKey(key string) (Principal, error) {
+	h := sha256.Sum256([]byte(key))
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(h[:], k.hash[:]) == 1 {
+			return k.principal, nil
+		}
+	}
+	return Principal{}, errors.New("invalid api key")
+}
+
+type roleClaims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+func (a *Authenticator) checkJWT(token string) (Principal, error) {
+	claims := &roleClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return a.jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil {
+		return Principal{}, errors.Wrap(err, "invalid token")
+	}
+	// the parser only checks exp when present, a token without it would never expire
+	if claims.ExpiresAt == nil {
+		return Principal{}, errors.New("token without expiry")
+	}
+	if a.jwtIssuer != "" && !claims.VerifyIssuer(a.jwtIssuer, true) {
+		return Principal{}, errors.New("invalid token issuer")
+	}
+	role, err := ParseRole(claims.Role)
+	if err != nil {
+		return Principal{}, errors.Wrap(err, "invalid token")
+	}
+	if claims.Subject == "" {
+		return Principal{}, errors.New("token without subject")
+	}
+	return Principal{Name: claims.Subject, Role: role}, nil
+}
+
+// middleware authenticates every request and attaches its Principal.
+func (a *Authenticator) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.disabled {
+			c.Set(principalKey, Principal{Name: "anonymous", Role: RoleAdmin})
+			return next(c)
+		}
+		p, err := a.authenticate(c.Request())
+		if err != nil {
+			log.Debug().Err(err).Str("remote", remoteIP(c)).Msg("request not authenticated")
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="hydro"`)
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+		c.Set(principalKey, p)
+		return next(c)
+	}
+}
+
+// queryTokenParam carries the credentials of the event streams, a browser EventSource can not set headers.
+const queryTokenParam = "access_token"
+
+// queryToken moves the access_token query param of the given routes into the Authorization header.
+// It is removed from every url so the credentials do not reach the logs and traces, which must run after it.
+func queryToken(routes ...string) echo.MiddlewareFunc {
+	allowed := make(map[string]bool, len(routes))
+	for _, r := range routes {
+		allowed[r] = true
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			q := req.URL.Query()
+			token := q.Get(queryTokenParam)
+			if token == "" {
+				return next(c)
+			}
+			q.Del(queryTokenParam)
+			req.URL.RawQuery = q.Encode()
+			if allowed[c.Path()] && req.Header.Get(echo.HeaderAuthorization) == "" && req.Header.Get("X-API-Key") == "" {
+				req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+			}
+			return next(c)
+		}
+	}
+}
+
+// requireRole rejects callers without at least the given role.
+func requireRole(role Role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p := principal(c)
+			if !p.Role.allows(role) {
+				log.Debug().Str("caller", p.Name).Str("role", string(p.Role)).Str("required", string(role)).Msg("request forbidden")
+				return echo.NewHTTPError(http.StatusForbidden)
+			}
+			return next(c)
+		}
+	}
+}
+
+// principal returns the caller attached by the authentication middleware.
+func principal(c echo.Context) Principal {
+	p, _ := c.Get(principalKey).(Principal)
+	return p
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo"
+)
+
+const testSecret = "secret"
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims roleClaims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("can not sign token: %v", err)
+	}
+	return s
+}
+
+func validClaims() roleClaims {
+	return roleClaims{
+		Role: "operator",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "grafana",
+			Issuer:    "hydro",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+}
+
+func TestNewAuthenticatorKeys(t *testing.T) {
+	for _, keys := range [][]string{
+		{"ci:admin"},
+		{":admin:key"},
+		{"ci:admin:"},
+		{"ci:root:key"},
+		nil,
+	} {
+		if _, err := NewAuthenticator(&AuthConfig{APIKeys: keys}); err == nil {
+			t.Errorf("keys %q accepted", keys)
+		}
+	}
+	if _, err := NewAuthenticator(&AuthConfig{Disabled: true}); err != nil {
+		t.Errorf("disabled authentication rejected: %v", err)
+	}
+
+	a, err := NewAuthenticator(&AuthConfig{APIKeys: []string{" ci:Operator:k:with:colons "}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p, err := a.checkKey("k:with:colons")
+	if err != nil || p != (Principal{Name: "ci", Role: RoleOperator}) {
+		t.Errorf("key resolved to %+v %v", p, err)
+	}
+	if _, err := a.checkKey("other"); err == nil {
+		t.Error("unknown key accepted")
+	}
+}
+
+func TestCheckJWT(t *testing.T) {
+	a, err := NewAuthenticator(&AuthConfig{JWTSecret: testSecret, JWTIssuer: "hydro"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p, err := a.checkJWT(signToken(t, jwt.SigningMethodHS256, []byte(testSecret), validClaims()))
+	if err != nil || p != (Principal{Name: "grafana", Role: RoleOperator}) {
+		t.Fatalf("valid token resolved to %+v %v", p, err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method jwt.SigningMethod
+		key    interface{}
+		change func(*roleClaims)
+	}{
+		{"other algorithm", jwt.SigningMethodHS512, []byte(testSecret), nil},
+		{"unsigned", jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, nil},
+		{"wrong secret", jwt.SigningMethodHS256, []byte("other"), nil},
+		{"wrong issuer", jwt.SigningMethodHS256, []byte(testSecret), func(c *roleClaims) { c.Issuer = "other" }},
+		{"no subject", jwt.SigningMethodHS256, []byte(testSecret), func(c *roleClaims) { c.Subject = "" }},
+		{"unknown role", jwt.SigningMethodHS256, []byte(testSecret), func(c *roleClaims) { c.Role = "root" }},
+		{"no expiry", jwt.SigningMethodHS256, []byte(testSecret), func(c *roleClaims) { c.ExpiresAt = nil }},
+		{"expired", jwt.SigningMethodHS256, []byte(testSecret), func(c *roleClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+		}},
+	} {
+		claims := validClaims()
+		if tc.change != nil {
+			tc.change(&claims)
+		}
+		if p, err := a.checkJWT(signToken(t, tc.method, tc.key, claims)); err == nil {
+			t.Errorf("%s: token accepted as %+v", tc.name, p)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	a, err := NewAuthenticator(&AuthConfig{APIKeys: []string{"viewer:viewer:vkey", "ops:operator:okey"}, JWTSecret: testSecret})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.String(http.StatusOK, principal(c).Name) }
+	e.GET("/read", ok, a.middleware)
+	e.POST("/write", ok, a.middleware, requireRole(RoleOperator))
+
+	token := signToken(t, jwt.SigningMethodHS256, []byte(testSecret), validClaims())
+	for _, tc := range []struct {
+		method string
+		path   string
+		header string
+		value  string
+		status int
+		caller string
+	}{
+		{http.MethodGet, "/read", "", "", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/read", "X-API-Key", "wrong", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/read", "X-API-Key", "vkey", http.StatusOK, "viewer"},
+		{http.MethodGet, "/read", echo.HeaderAuthorization, "Bearer okey", http.StatusOK, "ops"},
+		{http.MethodGet, "/read", echo.HeaderAuthorization, "Basic okey", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/read", echo.HeaderAuthorization, "Bearer " + token, http.StatusOK, "grafana"},
+		{http.MethodPost, "/write", "X-API-Key", "vkey", http.StatusForbidden, ""},
+		{http.MethodPost, "/write", "X-API-Key", "okey", http.StatusOK, "ops"},
+		{http.MethodPost, "/write", echo.HeaderAuthorization, "Bearer " + token, http.StatusOK, "grafana"},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s %s %s: status %d, want %d", tc.method, tc.path, tc.value, rec.Code, tc.status)
+			continue
+		}
+		if tc.status == http.StatusUnauthorized && rec.Header().Get(echo.HeaderWWWAuthenticate) == "" {
+			t.Errorf("%s %s: 401 without WWW-Authenticate", tc.method, tc.path)
+		}
+		if tc.caller != "" && rec.Body.String() != tc.caller {
+			t.Errorf("%s %s: caller %q, want %q", tc.method, tc.path, rec.Body.String(), tc.caller)
+		}
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	a, err := NewAuthenticator(&AuthConfig{Disabled: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e := echo.New()
+	e.POST("/write", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, a.middleware, requireRole(RoleAdmin))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d with authentication disabled", rec.Code)
+	}
+}
+
+func TestQueryToken(t *testing.T) {
+	e := echo.New()
+	e.Use(queryToken("/stream"))
+	var auth, query string
+	h := func(c echo.Context) error {
+		auth, query = c.Request().Header.Get(echo.HeaderAuthorization), c.Request().URL.RawQuery
+		return c.NoContent(http.StatusOK)
+	}
+	e.GET("/stream", h)
+	e.GET("/other", h)
+	for _, tc := range []struct {
+		path   string
+		header string
+		auth   string
+		query  string
+	}{
+		{"/stream?access_token=key&x=1", "", "Bearer key", "x=1"},
+		{"/stream?x=1", "", "", "x=1"},
+		// explicit credentials win over the query
+		{"/stream?access_token=key", "Bearer other", "Bearer other", ""},
+		// other routes do not take the token but it is still kept out of the logs
+		{"/other?access_token=key", "", "", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set(echo.HeaderAuthorization, tc.header)
+		}
+		e.ServeHTTP(httptest.NewRecorder(), req)
+		if auth != tc.auth || query != tc.query {
+			t.Errorf("%s: authorization %q query %q, want %q %q", tc.path, auth, query, tc.auth, tc.query)
+		}
+	}
+}
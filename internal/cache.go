@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNoReading is returned when there is no recent sensor reading to serve.
+var ErrNoReading = errors.New("no recent sensor reading")
+
+// SensorCacheConfig structure containing the latest readings cache settings.
+type SensorCacheConfig struct {
+	RefreshInterval time.Duration
+}
+
+// SensorCache keeps the latest reading of every sensor of every device in memory. It is updated by
+// the readings received from the controllers and periodically refreshed from the repository.
+type SensorCache struct {
+	repo HydroponicRepo
+	reg  *DeviceRegistry
+
+	mu     sync.RWMutex
+	latest map[string]LatestReadings
+}
+
+// NewSensorCache returns a cache seeded from the repository, the cleanup function stops the refresh.
+func NewSensorCache(ctx context.Context, cfg *SensorCacheConfig, reg *DeviceRegistry, src TelemetrySource, repo HydroponicRepo) (*SensorCache, func(), error) {
+	c := &SensorCache{repo: repo, reg: reg, latest: make(map[string]LatestReadings)}
+	c.refresh(ctx)
+	src.OnSensorData(c.update)
+
+	if cfg.RefreshInterval <= 0 {
+		return c, func() {}, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(cfg.RefreshInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				c.refresh(ctx)
+			}
+		}
+	}()
+	return c, func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+func (c *SensorCache) refresh(ctx context.Context) {
+	for _, device := range c.reg.IDs() {
+		l, err := c.repo.GetLatest(ctx, device)
+		if err != nil {
+			log.Error().Err(err).Str("device", device).Msg("can not refresh latest sensor readings")
+			continue
+		}
+		c.mu.Lock()
+		cur := c.latest[device]
+		cur.mergeLatest(l)
+		c.latest[device] = cur
+		c.mu.Unlock()
+	}
+}
+
+func (c *SensorCache) update(d SensorData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cur := c.latest[d.Device]
+	cur.merge(d)
+	c.latest[d.Device] = cur
+}
+
+// Latest returns the most recent reading of every sensor of the device.
+func (c *SensorCache) Latest(device string) LatestReadings {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.latest[device]
+}
+
+// LatestPh implements PhSource.
+func (c *SensorCache) LatestPh(_ context.Context, device string) (float64, time.Time, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	l := c.latest[device]
+	if l.PH == nil {
+		return 0, time.Time{}, ErrNoReading
+	}
+	return l.PH.Value, l.PH.Timestamp, nil
+}
+
+// LatestWaterLevel implements WaterLevelSource.
+func (c *SensorCache) LatestWaterLevel(_ context.Context, device string) (bool, time.Time, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	l := c.latest[device]
+	if l.MinWaterLevel == nil {
+		return false, time.Time{}, ErrNoReading
+	}
+	return l.MinWaterLevel.Value, l.MinWaterLevel.Timestamp, nil
+}
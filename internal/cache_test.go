@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func newTestSensorCache(t *testing.T, repo *fakeRepo) (*SensorCache, *fakeTelemetry) {
+	t.Helper()
+	reg, err := NewDeviceRegistry(&DeviceConfig{Devices: []string{"tank-1", "tank-2"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	src := &fakeTelemetry{}
+	c, closeCache, err := NewSensorCache(context.Background(), &SensorCacheConfig{}, reg, src, repo)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(closeCache)
+	return c, src
+}
+
+func TestSensorCacheSeed(t *testing.T) {
+	ctx := context.Background()
+	ts := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	repo := &fakeRepo{}
+	// tank-2 can not be read from the repository
+	repo.setLatest("tank-1", LatestReadings{
+		PH:            &Reading[float64]{Value: 6.1, Timestamp: ts},
+		MinWaterLevel: &Reading[bool]{Value: true, Timestamp: ts.Add(time.Minute)},
+	})
+	c, _ := newTestSensorCache(t, repo)
+
+	ph, phTs, err := c.LatestPh(ctx, "tank-1")
+	if err != nil || ph != 6.1 || !phTs.Equal(ts) {
+		t.Errorf("seeded ph %v at %v, %v", ph, phTs, err)
+	}
+	low, lvlTs, err := c.LatestWaterLevel(ctx, "tank-1")
+	if err != nil || !low || !lvlTs.Equal(ts.Add(time.Minute)) {
+		t.Errorf("seeded water level %v at %v, %v", low, lvlTs, err)
+	}
+	if l := c.Latest("tank-1"); l.Light != nil || l.SoilMoisture != nil {
+		t.Errorf("readings the repository did not return: %+v", l)
+	}
+	for _, device := range []string{"tank-2", "tank-3"} {
+		if _, _, err := c.LatestPh(ctx, device); !errors.Is(err, ErrNoReading) {
+			t.Errorf("%s: ph %v, want no reading", device, err)
+		}
+		if _, _, err := c.LatestWaterLevel(ctx, device); !errors.Is(err, ErrNoReading) {
+			t.Errorf("%s: water level %v, want no reading", device, err)
+		}
+	}
+
+	// a later refresh fills the device the first one missed
+	repo.setLatest("tank-2", LatestReadings{PH: &Reading[float64]{Value: 5.8, Timestamp: ts}})
+	c.refresh(ctx)
+	if ph, _, err := c.LatestPh(ctx, "tank-2"); err != nil || ph != 5.8 {
+		t.Errorf("refreshed ph %v, %v", ph, err)
+	}
+}
+
+func TestSensorCacheOrdering(t *testing.T) {
+	ctx := context.Background()
+	ts := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	repo := &fakeRepo{}
+	repo.setLatest("tank-1", LatestReadings{})
+	c, src := newTestSensorCache(t, repo)
+	v := func(f float64) *float64 { return &f }
+	b := func(v bool) *bool { return &v }
+
+	src.sensors.notify(SensorData{Device: "tank-1", PH: v(6.0), MinWaterLevel: b(false), Timestamp: ts.Add(2 * time.Minute)})
+	// a reading delivered late does not replace a newer one
+	src.sensors.notify(SensorData{Device: "tank-1", PH: v(5.0), MinWaterLevel: b(true), Timestamp: ts.Add(time.Minute)})
+	if ph, _, _ := c.LatestPh(ctx, "tank-1"); ph != 6.0 {
+		t.Errorf("ph %v after an older reading, want 6.0", ph)
+	}
+	if low, _, _ := c.LatestWaterLevel(ctx, "tank-1"); low {
+		t.Error("water level replaced by an older reading")
+	}
+	// a partial snapshot only updates its own readings
+	src.sensors.notify(SensorData{Device: "tank-1", Light: v(300), Timestamp: ts.Add(3 * time.Minute)})
+	if l := c.Latest("tank-1"); l.Light == nil || l.PH == nil || l.PH.Value != 6.0 {
+		t.Errorf("readings after a partial snapshot: %+v", l)
+	}
+
+	// the refresh only applies what is newer than the received readings
+	repo.setLatest("tank-1", LatestReadings{
+		PH:            &Reading[float64]{Value: 5.5, Timestamp: ts},
+		MinWaterLevel: &Reading[bool]{Value: true, Timestamp: ts.Add(5 * time.Minute)},
+	})
+	c.refresh(ctx)
+	if ph, phTs, _ := c.LatestPh(ctx, "tank-1"); ph != 6.0 || !phTs.Equal(ts.Add(2*time.Minute)) {
+		t.Errorf("ph %v at %v after refreshing an older value", ph, phTs)
+	}
+	if low, lvlTs, _ := c.LatestWaterLevel(ctx, "tank-1"); !low || !lvlTs.Equal(ts.Add(5*time.Minute)) {
+		t.Errorf("water level %v at %v after refreshing a newer value", low, lvlTs)
+	}
+	// a failed refresh keeps the cached readings
+	repo.mu.Lock()
+	delete(repo.latest, "tank-1")
+	repo.mu.Unlock()
+	c.refresh(ctx)
+	if _, _, err := c.LatestPh(ctx, "tank-1"); err != nil {
+		t.Errorf("ph lost by a failed refresh: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// certReloader serves the API certificate and reloads it when the files change on disk.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lastModified returns the latest modification time of the certificate and key files.
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		st, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load() error {
+	mod, err := r.lastModified()
+	if err != nil {
+		return errors.Wrap(err, "can not read api certificate")
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "can not load api certificate")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.modTime = &cert, mod
+	return nil
+}
+
+// watch reloads the certificate every interval when the files changed, the old one is kept on errors.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			mod, err := r.lastModified()
+			r.mu.RLock()
+			changed := err == nil && mod.After(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err = r.load(); err != nil {
+				log.Error().Err(err).Msg("can not reload api certificate, keeping the current one")
+				continue
+			}
+			log.Info().Str("cert", r.certFile).Msg("api certificate reloaded")
+		}
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for name and its key, with the given modification time.
+func writeTestCert(t *testing.T, certFile, keyFile, name string, mod time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for file, block := range map[string]*pem.Block{certFile: {Type: "CERTIFICATE", Bytes: der}, keyFile: {Type: "EC PRIVATE KEY", Bytes: keyDer}} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func servedName(t *testing.T, r *certReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key")
+	now := time.Now()
+	writeTestCert(t, certFile, keyFile, "old.hydro", now.Add(-time.Hour))
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.watch(ctx, 5*time.Millisecond)
+
+	// waitFor polls the served certificate until it is issued to name
+	waitFor := func(name string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for servedName(t, r) != name {
+			if time.Now().After(deadline) {
+				t.Fatalf("served %s, want %s", servedName(t, r), name)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor("old.hydro")
+
+	// a key that does not match the certificate is not loaded
+	writeTestCert(t, certFile, filepath.Join(dir, "other.key"), "broken.hydro", now)
+	if err := os.Chtimes(keyFile, now, now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if name := servedName(t, r); name != "old.hydro" {
+		t.Errorf("served %s after a broken renewal, want the old certificate", name)
+	}
+
+	writeTestCert(t, certFile, keyFile, "new.hydro", now.Add(time.Minute))
+	waitFor("new.hydro")
+}
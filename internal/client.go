@@ -1,19 +1,46 @@
 package internal
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-playground/validator"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type HydroponicClient interface {
-	SendUpPh() error
-	SendDownPh() error
-	SendAddSoil() error
-	SendAddWater() error
-	SendChangeLight() error
-	GetLightState() *LightState
+	SendUpPh(ctx context.Context, device string) error
+	SendDownPh(ctx context.Context, device string) error
+	SendAddSoil(ctx context.Context, device string) error
+	SendAddWater(ctx context.Context, device string) error
+	SendChangeLight(ctx context.Context, device string) error
+	SetLight(ctx context.Context, device string, on bool) error
+	// Send publishes cmd with parameters, the shorthand methods send it with the controller defaults.
+	Send(ctx context.Context, device string, cmd Command, p CommandParams) error
+}
+
+// TelemetrySource lets other components subscribe to data published by the controller
+// and to the results of the commands sent to it.
+type TelemetrySource interface {
+	OnSensorData(fn func(SensorData))
+	OnLightState(fn func(LightState))
+	OnDeviceError(fn func(DeviceError))
+	OnCommandResult(fn func(CommandResult))
 }
 
 type Command uint8
@@ -24,86 +51,636 @@ const (
 	LightChangeCommand
 	SoilCommand
 	AddWaterCommand
+	LightOnCommand
+	LightOffCommand
+)
+
+var commandNames = [...]string{
+	PhUpCommand:        "ph_up",
+	PhDownCommand:      "ph_down",
+	LightChangeCommand: "light_change",
+	SoilCommand:        "soil",
+	AddWaterCommand:    "add_water",
+	LightOnCommand:     "light_on",
+	LightOffCommand:    "light_off",
+}
+
+func (c Command) String() string {
+	if int(c) < len(commandNames) {
+		return commandNames[c]
+	}
+	return fmt.Sprintf("command_%d", uint8(c))
+}
+
+// Every device has its own topics named hydroponic/{device}/{kind}.
+const mqttTopicPrefix = "hydroponic"
+const mqttCommandTopic = "command"
+const mqttAckTopic = "ack"
+const mqttLightTopic = "light"
+const mqttErrorTopic = "error"
+const mqttSensorTopic = "sensors"
+const mqttBirthTopic = "birth"
+const mqttStatusTopic = "status"
+
+// deviceTopic returns the topic of kind for the device, "+" subscribes to every device.
+func deviceTopic(device, kind string) string {
+	return mqttTopicPrefix + "/" + device + "/" + kind
+}
+
+// legacyTopic returns the topic of kind used by the firmware without device topics.
+func legacyTopic(kind string) string {
+	return mqttTopicPrefix + "/" + kind
+}
+
+// topicDevice returns the device id of a device topic.
+func topicDevice(topic string) (string, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[0] != mqttTopicPrefix || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+const defaultAckTimeout = 5 * time.Second
+
+var (
+	// ErrPublishTimeout is returned when the broker does not confirm the publish before the deadline.
+	ErrPublishTimeout = errors.New("command publish timed out")
+	// ErrAckTimeout is returned when the broker accepted the command but the controller did not acknowledge it in time.
+	ErrAckTimeout = errors.New("command acknowledgement timed out")
+	// ErrClientClosing is returned for commands sent after the client started shutting down.
+	ErrClientClosing = errors.New("mqtt client is shutting down")
+)
+
+// Drainer is implemented by clients that can wait for their in-flight commands on shutdown.
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// CommandError is returned when the controller acknowledges a command with an error.
+type CommandError struct {
+	ID      string
+	Command Command
+	Err     string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("command %s (%s) rejected by controller: %s", e.Command, e.ID, e.Err)
+}
+
+// CommandOutcome is how a sent command ended.
+type CommandOutcome string
+
+const (
+	OutcomeAcknowledged   CommandOutcome = "acknowledged"
+	OutcomeRejected       CommandOutcome = "rejected"
+	OutcomeAckTimeout     CommandOutcome = "ack_timeout"
+	OutcomePublishTimeout CommandOutcome = "publish_timeout"
+	OutcomeFailed         CommandOutcome = "failed"
+	OutcomeQueued         CommandOutcome = "queued"
+	OutcomeExpired        CommandOutcome = "expired"
 )
 
-const mqttCommandTopic = "hydroponic/command"
-const mqttLightTopic = "hydroponic/light"
-const mqttErrorTopic = "hydroponic/error"
+// CommandResult describes a command sent to the controller and its outcome.
+type CommandResult struct {
+	ID        string         `json:"id"`
+	Device    string         `json:"device"`
+	Command   Command        `json:"command"`
+	Name      string         `json:"name"`
+	Outcome   CommandOutcome `json:"outcome"`
+	Err       string         `json:"err,omitempty"`
+	Params    *CommandParams `json:"params,omitempty"`
+	Timestamp time.Time      `json:"ts"`
+	CommandOrigin
+}
+
+func commandOutcome(err error) CommandOutcome {
+	var cmdErr *CommandError
+	switch {
+	case err == nil:
+		return OutcomeAcknowledged
+	case errors.Is(err, ErrAckTimeout):
+		return OutcomeAckTimeout
+	case errors.Is(err, ErrPublishTimeout):
+		return OutcomePublishTimeout
+	case errors.Is(err, ErrCommandQueued):
+		return OutcomeQueued
+	case errors.Is(err, ErrCommandExpired):
+		return OutcomeExpired
+	case errors.As(err, &cmdErr):
+		return OutcomeRejected
+	default:
+		return OutcomeFailed
+	}
+}
+
+// commandMayHaveRun reports whether the controller may have executed a command that ended with err:
+// it was acknowledged, its acknowledgement was lost or it waits in the outbox.
+func commandMayHaveRun(err error) bool {
+	return err == nil || errors.Is(err, ErrAckTimeout) || errors.Is(err, ErrCommandQueued)
+}
+
+// DeviceError is an error reported by the controller.
+type DeviceError struct {
+	Device    string    `json:"device"`
+	Topic     string    `json:"topic"`
+	MessageID uint16    `json:"messageId"`
+	Err       string    `json:"err"`
+	Timestamp time.Time `json:"ts"`
+}
 
 type MqttHydroponicClient struct {
 	cli        mqtt.Client
-	lightState bool
+	reg        *DeviceRegistry
+	outbox     *Outbox
+	ackTimeout time.Duration
+
+	mu       sync.Mutex
+	pending  map[string]chan CommandAck
+	closing  bool
+	inflight sync.WaitGroup
+	// replaySpacing is the minimum time between two replays of a command to a device
+	replaySpacing func(Command) time.Duration
+
+	validate *validator.Validate
+	sensors  listeners[SensorData]
+	lights   listeners[LightState]
+	errs     listeners[DeviceError]
+	results  listeners[CommandResult]
 }
 
+// MqttConfig structure containing the broker connection settings. TLS is used when the broker url
+// has the ssl, tls, mqtts or wss scheme, credentials are optional.
 type MqttConfig struct {
 	MqttBroker string
+	AckTimeout time.Duration
+	ClientID   string
+	Username   string
+	Password   string
+
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+
+	ConnectTimeout       time.Duration
+	KeepAlive            time.Duration
+	ConnectRetryInterval time.Duration
+	MaxReconnectInterval time.Duration
+}
+
+func (mc *MqttConfig) checkConfig() error {
+	log.Debug().Msg("checking mqtt config")
+
+	if mc.MqttBroker == "" {
+		return errors.New("mqtt broker is not configured")
+	}
+	if mc.ClientID == "" {
+		mc.ClientID = "hydro_mqtt_client"
+	}
+	if mc.AckTimeout <= 0 {
+		mc.AckTimeout = defaultAckTimeout
+	}
+	if mc.ConnectTimeout <= 0 {
+		mc.ConnectTimeout = 30 * time.Second
+	}
+	if mc.KeepAlive <= 0 {
+		mc.KeepAlive = 30 * time.Second
+	}
+	if mc.ConnectRetryInterval <= 0 {
+		mc.ConnectRetryInterval = 5 * time.Second
+	}
+	if mc.MaxReconnectInterval <= 0 {
+		mc.MaxReconnectInterval = 2 * time.Minute
+	}
+	if (mc.CertFile == "") != (mc.KeyFile == "") {
+		return errors.New("mqtt client certificate and key must be set together")
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS settings for the broker connection, nil when TLS is not configured.
+func (mc *MqttConfig) tlsConfig() (*tls.Config, error) {
+	scheme := strings.ToLower(strings.SplitN(mc.MqttBroker, "://", 2)[0])
+	secure := scheme == "ssl" || scheme == "tls" || scheme == "mqtts" || scheme == "wss"
+	if !secure {
+		if mc.CAFile != "" || mc.CertFile != "" {
+			return nil, fmt.Errorf("mqtt certificates are set but broker %s does not use tls", mc.MqttBroker)
+		}
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: mc.InsecureSkipVerify}
+	if mc.CAFile != "" {
+		pem, err := os.ReadFile(mc.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not read mqtt ca bundle")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", mc.CAFile)
+		}
+	}
+	if mc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(mc.CertFile, mc.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not load mqtt client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
 }
 
 type MqttError struct {
 	Err string `json:"err"`
 }
 
+// CommandMessage is the payload published to the command topic.
+type CommandMessage struct {
+	ID     string         `json:"id"`
+	Cmd    Command        `json:"command"`
+	Params *CommandParams `json:"params,omitempty"`
+	// Trace carries the w3c trace context of the request, the controller may continue the trace.
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// ErrInvalidParams is returned when the parameters do not fit the command.
+var ErrInvalidParams = errors.New("invalid command parameters")
+
+// CommandParams tune a command, unset parameters leave the controller defaults.
+// Dosing commands take either a volume in millilitres or a pump run time, light_on takes the intensity in percent.
+type CommandParams struct {
+	Ml         *float64 `json:"ml,omitempty" validate:"omitempty,gt=0,lte=500"`
+	DurationMs *uint32  `json:"durationMs,omitempty" validate:"omitempty,min=100,max=600000"`
+	Intensity  *uint8   `json:"intensity,omitempty" validate:"omitempty,min=1,max=100"`
+}
+
+var paramsValidator = validator.New()
+
+// Empty reports whether no parameter is set.
+func (p CommandParams) Empty() bool {
+	return p.Ml == nil && p.DurationMs == nil && p.Intensity == nil
+}
+
+// check validates the ranges and that cmd accepts the parameters.
+func (p CommandParams) check(cmd Command) error {
+	if err := paramsValidator.Struct(p); err != nil {
+		return errors.Wrap(ErrInvalidParams, err.Error())
+	}
+	switch cmd {
+	case PhUpCommand, PhDownCommand, SoilCommand, AddWaterCommand:
+		if p.Ml != nil && p.DurationMs != nil {
+			return errors.Wrapf(ErrInvalidParams, "%s takes either ml or durationMs", cmd)
+		}
+		if p.Intensity != nil {
+			return errors.Wrapf(ErrInvalidParams, "%s does not take intensity", cmd)
+		}
+	case LightOnCommand:
+		if p.Ml != nil || p.DurationMs != nil {
+			return errors.Wrapf(ErrInvalidParams, "%s takes only intensity", cmd)
+		}
+	default:
+		if !p.Empty() {
+			return errors.Wrapf(ErrInvalidParams, "%s does not take parameters", cmd)
+		}
+	}
+	return nil
+}
+
+// CommandAck is the reply of the controller to a command, correlated by ID.
+type CommandAck struct {
+	ID  string `json:"id"`
+	Err string `json:"err,omitempty"`
+}
+
 type LightState struct {
-	IsUp bool `json:"isUp"`
+	Device string `json:"device,omitempty"`
+	IsUp   bool   `json:"isUp"`
 }
 
-func NewMqttHydroponicClient(config *MqttConfig) (*MqttHydroponicClient, func(), error) {
+func NewMqttHydroponicClient(config *MqttConfig, reg *DeviceRegistry, outbox *Outbox) (*MqttHydroponicClient, func(), error) {
+	c := *config
+	if err := c.checkConfig(); err != nil {
+		return nil, nil, err
+	}
+	tlsCfg, err := c.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Debug().
+		Str("broker", c.MqttBroker).
+		Str("client id", c.ClientID).
+		Bool("tls", tlsCfg != nil).
+		Bool("credentials", c.Username != "").
+		Msg("connecting to mqtt broker")
+
+	m := &MqttHydroponicClient{
+		reg:        reg,
+		outbox:     outbox,
+		ackTimeout: c.AckTimeout,
+		pending:    make(map[string]chan CommandAck),
+		validate:   validator.New(),
+	}
+
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(config.MqttBroker)
-	opts.SetClientID("hydro_mqtt_client")
+	opts.AddBroker(c.MqttBroker)
+	opts.SetClientID(c.ClientID)
+	opts.SetUsername(c.Username)
+	opts.SetPassword(c.Password)
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+	opts.SetConnectTimeout(c.ConnectTimeout)
+	opts.SetKeepAlive(c.KeepAlive)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(c.ConnectRetryInterval)
+	opts.SetMaxReconnectInterval(c.MaxReconnectInterval)
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
 		log.Info().Msg("mqtt broker connected")
+		m.subscribe(client)
+		m.replayOutbox()
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Error().Err(err).Msg("mqtt broker connection lost, reconnecting")
+	})
+	opts.SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+		log.Debug().Msg("reconnecting to mqtt broker")
 	})
 	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
 		log.Info().Msgf("Received message: %s from topic: %s", msg.Payload(), msg.Topic())
 	})
-	mqttClient := mqtt.NewClient(opts)
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
+	m.cli = mqtt.NewClient(opts)
+
+	// with connect retry the token completes only once connected, the first attempt is bounded here
+	token := m.cli.Connect()
+	if !token.WaitTimeout(c.ConnectTimeout) {
+		m.cli.Disconnect(0)
+		return nil, nil, fmt.Errorf("can not connect to mqtt broker %s in %s", c.MqttBroker, c.ConnectTimeout)
+	}
+	if token.Error() != nil {
 		return nil, nil, errors.Wrap(token.Error(), "can not connect to mqtt")
 	}
-	m := &MqttHydroponicClient{mqttClient, false}
-	mqttClient.Subscribe(mqttLightTopic, 1, m.receiveLightState)
-	mqttClient.Subscribe(mqttErrorTopic, 1, m.receiveError(mqttErrorTopic))
 	return m, m.Close, nil
 }
 
-func (m *MqttHydroponicClient) receiveLightState(_ mqtt.Client, message mqtt.Message) {
+// subscribe registers the device topics, it runs on every connect since a clean session drops them.
+func (m *MqttHydroponicClient) subscribe(client mqtt.Client) {
+	type subscription struct {
+		topic   string
+		handler mqtt.MessageHandler
+	}
+	// birth and status are expected to be retained, so the presence is known right after subscribing.
+	// The broker sends the retained messages in the order of the subscriptions, the birth goes first so a
+	// discovered device is registered before its status arrives.
+	subs := []subscription{
+		{deviceTopic("+", mqttBirthTopic), m.receiveBirth},
+		{deviceTopic("+", mqttStatusTopic), m.knownDevice(m.receiveStatus)},
+		{deviceTopic("+", mqttLightTopic), m.fromDevice(m.receiveLightState)},
+		{deviceTopic("+", mqttErrorTopic), m.fromDevice(m.receiveError)},
+		{deviceTopic("+", mqttAckTopic), m.fromDevice(m.receiveAck)},
+		{deviceTopic("+", mqttSensorTopic), m.fromDevice(m.receiveSensorData)},
+	}
+	if m.reg.Legacy() != "" {
+		for _, sub := range subs[2:] {
+			kind := sub.topic[strings.LastIndex(sub.topic, "/")+1:]
+			subs = append(subs, subscription{legacyTopic(kind), sub.handler})
+		}
+	}
+	for _, sub := range subs {
+		t := client.Subscribe(sub.topic, 1, sub.handler)
+		go func(topic string) {
+			if t.WaitTimeout(m.ackTimeout) && t.Error() != nil {
+				log.Error().Err(t.Error()).Str("topic", topic).Msg("can not subscribe")
+			}
+		}(sub.topic)
+	}
+}
+
+// fromDevice is knownDevice that also records the message as a sign of life of the device.
+func (m *MqttHydroponicClient) fromDevice(handler func(device string, message mqtt.Message)) mqtt.MessageHandler {
+	return m.knownDevice(func(device string, message mqtt.Message) {
+		m.reg.seen(device, time.Now())
+		handler(device, message)
+	})
+}
+
+// knownDevice resolves the device of the message topic and drops messages of unknown devices.
+func (m *MqttHydroponicClient) knownDevice(handler func(device string, message mqtt.Message)) mqtt.MessageHandler {
+	return func(_ mqtt.Client, message mqtt.Message) {
+		device, ok := m.topicDevice(message.Topic())
+		if !ok || !m.reg.Has(device) {
+			defer message.Ack()
+			log.Warn().Str("topic", message.Topic()).Msg("message from unknown device dropped")
+			return
+		}
+		handler(device, message)
+	}
+}
+
+// topicDevice resolves the device of the topic, the legacy topics belong to the legacy device.
+func (m *MqttHydroponicClient) topicDevice(topic string) (string, bool) {
+	if device, ok := topicDevice(topic); ok {
+		return device, true
+	}
+	if legacy := m.reg.Legacy(); legacy != "" && strings.Count(topic, "/") == 1 && strings.HasPrefix(topic, mqttTopicPrefix+"/") {
+		return legacy, true
+	}
+	return "", false
+}
+
+// commandTopic returns the topic the commands of the device are published to.
+func (m *MqttHydroponicClient) commandTopic(device string) string {
+	if device == m.reg.Legacy() {
+		return legacyTopic(mqttCommandTopic)
+	}
+	return deviceTopic(device, mqttCommandTopic)
+}
+
+func (m *MqttHydroponicClient) receiveLightState(device string, message mqtt.Message) {
 	defer message.Ack()
 	var ls LightState
 	err := json.Unmarshal(message.Payload(), &ls)
 	if err != nil {
 		log.Error().
+			Str("device", device).
 			Str("payload", string(message.Payload())).
 			Uint16("messageId", message.MessageID()).
 			Msg("can not unmarshall light state")
 		return
 	}
-	m.lightState = ls.IsUp
+	ls.Device = device
+	m.lights.notify(ls)
 }
 
-func (m *MqttHydroponicClient) receiveError(topic string) func(_ mqtt.Client, message mqtt.Message) {
-	return func(_ mqtt.Client, message mqtt.Message) {
-		defer message.Ack()
-		var e MqttError
-		err := json.Unmarshal(message.Payload(), &e)
-		if err != nil {
-			log.Error().
-				Str("topic", topic).
-				Str("payload", string(message.Payload())).
-				Uint16("messageId", message.MessageID()).
-				Msg("can not unmarshall error")
-			return
-		}
+func (m *MqttHydroponicClient) receiveBirth(_ mqtt.Client, message mqtt.Message) {
+	defer message.Ack()
+	device, ok := topicDevice(message.Topic())
+	if !ok {
+		return
+	}
+	var b DeviceBirth
+	if err := json.Unmarshal(message.Payload(), &b); err != nil {
+		log.Error().
+			Str("device", device).
+			Str("payload", string(message.Payload())).
+			Uint16("messageId", message.MessageID()).
+			Msg("can not unmarshall device birth")
+		return
+	}
+	if err := m.reg.announce(device, b, time.Now(), message.Retained()); err != nil {
+		log.Warn().Err(err).Str("device", device).Msg("device announcement ignored")
+	}
+}
+
+func (m *MqttHydroponicClient) receiveStatus(device string, message mqtt.Message) {
+	defer message.Ack()
+	var p DevicePresence
+	err := json.Unmarshal(message.Payload(), &p)
+	if err == nil {
+		err = m.validate.Struct(&p)
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("device", device).
+			Str("payload", string(message.Payload())).
+			Uint16("messageId", message.MessageID()).
+			Msg("can not unmarshall device status")
+		return
+	}
+	m.reg.setStatus(device, p.Status)
+}
+
+func (m *MqttHydroponicClient) receiveError(device string, message mqtt.Message) {
+	defer message.Ack()
+	topic := message.Topic()
+	var e MqttError
+	err := json.Unmarshal(message.Payload(), &e)
+	if err != nil {
 		log.Error().
 			Str("topic", topic).
 			Str("payload", string(message.Payload())).
-			Str("error", e.Err).
 			Uint16("messageId", message.MessageID()).
-			Msg("receive error")
+			Msg("can not unmarshall error")
+		return
+	}
+	log.Error().
+		Str("topic", topic).
+		Str("payload", string(message.Payload())).
+		Str("error", e.Err).
+		Uint16("messageId", message.MessageID()).
+		Msg("receive error")
+	m.errs.notify(DeviceError{
+		Device:    device,
+		Topic:     topic,
+		MessageID: message.MessageID(),
+		Err:       e.Err,
+		Timestamp: time.Now(),
+	})
+}
+
+func (m *MqttHydroponicClient) receiveAck(device string, message mqtt.Message) {
+	defer message.Ack()
+	var a CommandAck
+	err := json.Unmarshal(message.Payload(), &a)
+	if err != nil || a.ID == "" {
+		log.Error().
+			Str("device", device).
+			Str("payload", string(message.Payload())).
+			Uint16("messageId", message.MessageID()).
+			Msg("can not unmarshall command ack")
+		return
+	}
+	m.mu.Lock()
+	ch, ok := m.pending[a.ID]
+	delete(m.pending, a.ID)
+	m.mu.Unlock()
+	if !ok {
+		log.Debug().Str("id", a.ID).Msg("ack for unknown or expired command")
+		return
+	}
+	ch <- a
+}
+
+func (m *MqttHydroponicClient) receiveSensorData(device string, message mqtt.Message) {
+	defer message.Ack()
+	d, err := decodeSensorData(m.validate, message.Payload(), time.Now())
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("device", device).
+			Str("payload", string(message.Payload())).
+			Uint16("messageId", message.MessageID()).
+			Msg("can not decode sensor data")
+		return
+	}
+	d.Device = device
+	m.sensors.notify(d)
+}
+
+// decodeSensorData parses and validates a sensor payload, readings without timestamp are stamped with now.
+func decodeSensorData(v *validator.Validate, payload []byte, now time.Time) (SensorData, error) {
+	var d SensorData
+	if err := json.Unmarshal(payload, &d); err != nil {
+		return d, err
+	}
+	if err := v.Struct(&d); err != nil {
+		return d, err
+	}
+	if d.Empty() {
+		return d, errors.New("sensor data has no readings")
+	}
+	if d.Timestamp.IsZero() {
+		d.Timestamp = now
+	}
+	return d, nil
+}
+
+// OnSensorData registers fn to be called with every valid reading received from the controller.
+func (m *MqttHydroponicClient) OnSensorData(fn func(SensorData)) {
+	m.sensors.add(fn)
+}
+
+// OnLightState registers fn to be called with every light state reported by the controller.
+func (m *MqttHydroponicClient) OnLightState(fn func(LightState)) {
+	m.lights.add(fn)
+}
+
+// OnDeviceError registers fn to be called with every error reported by the controller.
+func (m *MqttHydroponicClient) OnDeviceError(fn func(DeviceError)) {
+	m.errs.add(fn)
+}
+
+// OnCommandResult registers fn to be called when a sent command completes.
+func (m *MqttHydroponicClient) OnCommandResult(fn func(CommandResult)) {
+	m.results.add(fn)
+}
+
+// Drain rejects new commands and waits until the in-flight ones are acknowledged or time out.
+func (m *MqttHydroponicClient) Drain(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "pending commands were not drained")
 	}
 }
 
 func (m *MqttHydroponicClient) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.ackTimeout)
+	defer cancel()
+	if err := m.Drain(ctx); err != nil {
+		log.Warn().Err(err).Msg("disconnecting with commands in flight")
+	}
 	m.cli.Disconnect(250)
 }
 
@@ -111,54 +688,285 @@ type Marshaller[T any] interface {
 	Marshall() ([]byte, error)
 }
 
-func (m *MqttHydroponicClient) SendUpPh() error {
-	return sendCommand(m, PhUpCommand)
+func (m *MqttHydroponicClient) SendUpPh(ctx context.Context, device string) error {
+	return sendCommand(ctx, m, device, PhUpCommand, CommandParams{})
+}
+
+func (m *MqttHydroponicClient) SendDownPh(ctx context.Context, device string) error {
+	return sendCommand(ctx, m, device, PhDownCommand, CommandParams{})
 }
 
-func (m *MqttHydroponicClient) SendDownPh() error {
-	return sendCommand(m, PhDownCommand)
+func (m *MqttHydroponicClient) SendAddSoil(ctx context.Context, device string) error {
+	return sendCommand(ctx, m, device, SoilCommand, CommandParams{})
 }
 
-func (m *MqttHydroponicClient) SendAddSoil() error {
-	return sendCommand(m, SoilCommand)
+func (m *MqttHydroponicClient) SendAddWater(ctx context.Context, device string) error {
+	return sendCommand(ctx, m, device, AddWaterCommand, CommandParams{})
 }
 
-func (m *MqttHydroponicClient) SendAddWater() error {
-	return sendCommand(m, AddWaterCommand)
+func (m *MqttHydroponicClient) SendChangeLight(ctx context.Context, device string) error {
+	return sendCommand(ctx, m, device, LightChangeCommand, CommandParams{})
+}
+
+// SetLight switches the light to the given state, unlike SendChangeLight it is safe to repeat.
+func (m *MqttHydroponicClient) SetLight(ctx context.Context, device string, on bool) error {
+	if on {
+		return sendCommand(ctx, m, device, LightOnCommand, CommandParams{})
+	}
+	return sendCommand(ctx, m, device, LightOffCommand, CommandParams{})
 }
 
-func (m *MqttHydroponicClient) SendChangeLight() error {
-	return sendCommand(m, LightChangeCommand)
+func (m *MqttHydroponicClient) Send(ctx context.Context, device string, cmd Command, p CommandParams) error {
+	return sendCommand(ctx, m, device, cmd, p)
 }
 
-func (m *MqttHydroponicClient) GetLightState() *LightState {
-	return &LightState{m.lightState}
+func (cm CommandMessage) Marshall() ([]byte, error) {
+	if cm.Params != nil {
+		if err := cm.Params.check(cm.Cmd); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(cm)
 }
 
-func (c Command) Marshall() ([]byte, error) {
-	cmd := struct {
-		Cmd Command `json:"command"`
-	}{
-		c,
+// sendCommand publishes the command and blocks until the controller acknowledges it,
+// reports an error or the ack timeout expires.
+func sendCommand(ctx context.Context, m *MqttHydroponicClient, device string, cmd Command, p CommandParams) error {
+	if !m.reg.Has(device) {
+		return ErrUnknownDevice
+	}
+	if err := p.check(cmd); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if m.closing {
+		m.mu.Unlock()
+		return ErrClientClosing
+	}
+	m.inflight.Add(1)
+	m.mu.Unlock()
+	defer m.inflight.Done()
+
+	msg := CommandMessage{ID: newCorrelationID(), Cmd: cmd}
+	if !p.Empty() {
+		msg.Params = &p
+	}
+	ctx, span := startCommandSpan(ctx, "send", device, m.commandTopic(device), msg)
+	defer span.End()
+	msg.Trace = make(map[string]string)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(msg.Trace))
+
+	var err error
+	// commands wait behind the queued ones so the controller gets them in order
+	if !m.cli.IsConnectionOpen() || m.outbox.Len() > 0 {
+		err = m.queue(ctx, device, msg)
+	} else {
+		err = awaitCommand(ctx, m, device, msg)
 	}
-	return json.Marshal(cmd)
+	m.notifyResult(device, msg, commandOriginFrom(ctx), err)
+	span.SetAttributes(attribute.String("hydro.command.outcome", string(commandOutcome(err))))
+	if !errors.Is(err, ErrCommandQueued) {
+		spanError(span, err)
+	}
+	return err
+}
+
+// startCommandSpan starts the producer span of a command publish.
+func startCommandSpan(ctx context.Context, op, device, topic string, msg CommandMessage) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "command "+op+" "+msg.Cmd.String(),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "mqtt"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.String("messaging.message.id", msg.ID),
+			attribute.String("hydro.device", device),
+			attribute.String("hydro.command", msg.Cmd.String()),
+		))
 }
 
-func sendCommand[E Marshaller[any]](m *MqttHydroponicClient, command E) error {
-	b, err := command.Marshall()
+func (m *MqttHydroponicClient) notifyResult(device string, msg CommandMessage, origin CommandOrigin, err error) {
+	r := CommandResult{
+		ID:            msg.ID,
+		Device:        device,
+		Command:       msg.Cmd,
+		Name:          msg.Cmd.String(),
+		Params:        msg.Params,
+		Outcome:       commandOutcome(err),
+		Timestamp:     time.Now(),
+		CommandOrigin: origin,
+	}
 	if err != nil {
+		r.Err = err.Error()
+	}
+	m.results.notify(r)
+}
+
+// setReplaySpacing spaces out the replays of the same command to a device.
+func (m *MqttHydroponicClient) setReplaySpacing(fn func(Command) time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replaySpacing = fn
+}
+
+// queue stores the command in the outbox until the broker is reachable.
+func (m *MqttHydroponicClient) queue(ctx context.Context, device string, msg CommandMessage) error {
+	if err := m.outbox.push(device, msg, commandOriginFrom(ctx), time.Now()); err != nil {
+		log.Error().Err(err).Str("id", msg.ID).Str("device", device).Msg("can not queue command")
 		return err
 	}
-	p := m.cli.Publish(mqttCommandTopic, 1, false, b)
-	go handleTopicError(mqttCommandTopic, p)
-	return nil
+	log.Warn().Str("id", msg.ID).Str("device", device).Stringer("command", msg.Cmd).Msg("command queued in the outbox")
+	// the broker may have come back while the command was stored
+	m.replayOutbox()
+	return ErrCommandQueued
+}
+
+// replayOutbox sends the queued commands in order unless a replay already runs.
+func (m *MqttHydroponicClient) replayOutbox() {
+	if !m.cli.IsConnectionOpen() || !m.outbox.startReplay() {
+		return
+	}
+	go m.replay()
 }
 
-func handleTopicError(topic string, t mqtt.Token) {
-	t.Done()
+func (m *MqttHydroponicClient) replay() {
+	// last replay of every device and command, the queued doses are not published back to back
+	last := make(map[string]time.Time)
+	for {
+		e, ok := m.outbox.next()
+		if !ok {
+			return
+		}
+		m.mu.Lock()
+		spacing := m.replaySpacing
+		m.mu.Unlock()
+
+		now := time.Now()
+		key := e.Device + "/" + e.Message.Cmd.String()
+		var wait time.Duration
+		if t, ok := last[key]; ok && spacing != nil {
+			wait = t.Add(spacing(e.Message.Cmd)).Sub(now)
+		}
+		expired := now.After(e.ExpiresAt) || (wait > 0 && now.Add(wait).After(e.ExpiresAt))
+		if wait > 0 && !expired {
+			time.Sleep(wait)
+			continue
+		}
+		if !expired && !m.cli.IsConnectionOpen() {
+			// the next connect starts over
+			m.outbox.stopReplay()
+			return
+		}
+
+		m.mu.Lock()
+		if m.closing {
+			// kept in the outbox for the next start
+			m.mu.Unlock()
+			m.outbox.stopReplay()
+			return
+		}
+		m.inflight.Add(1)
+		m.mu.Unlock()
+		err := m.outbox.take(e.Message.ID)
+		switch {
+		case errors.Is(err, ErrOutboxEntryNotFound):
+			// removed through the api in the meantime
+			m.inflight.Done()
+			continue
+		case err != nil:
+			// dropped rather than risking a second publish after a restart
+			log.Error().Err(err).Str("id", e.Message.ID).Msg("can not remove queued command from the outbox")
+			err = errors.Wrap(err, "can not dequeue command")
+		case expired:
+			err = errors.Wrapf(ErrCommandExpired, "queued at %s", e.QueuedAt.Format(time.RFC3339))
+			log.Warn().Str("id", e.Message.ID).Str("device", e.Device).Stringer("command", e.Message.Cmd).Msg("dropping stale command")
+		default:
+			log.Info().Str("id", e.Message.ID).Str("device", e.Device).Stringer("command", e.Message.Cmd).Msg("replaying queued command")
+			// the replay continues the trace of the request that queued the command
+			ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(e.Message.Trace))
+			ctx, span := startCommandSpan(ctx, "replay", e.Device, m.commandTopic(e.Device), e.Message)
+			// a failed publish is not retried, the broker may still deliver it
+			err = spanError(span, awaitCommand(ctx, m, e.Device, e.Message))
+			span.End()
+			last[key] = time.Now()
+		}
+		m.notifyResult(e.Device, e.Message, e.Origin, err)
+		m.inflight.Done()
+	}
+}
+
+func awaitCommand(ctx context.Context, m *MqttHydroponicClient, device string, msg CommandMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, m.ackTimeout)
+	defer cancel()
+
+	ack := make(chan CommandAck, 1)
+	m.mu.Lock()
+	m.pending[msg.ID] = ack
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.pending, msg.ID)
+		m.mu.Unlock()
+	}()
+
+	if err := publish(ctx, m, m.commandTopic(device), msg); err != nil {
+		return err
+	}
+
+	select {
+	case a := <-ack:
+		if a.Err != "" {
+			return &CommandError{ID: msg.ID, Command: msg.Cmd, Err: a.Err}
+		}
+		log.Debug().Str("id", msg.ID).Str("device", device).Stringer("command", msg.Cmd).Msg("command acknowledged")
+		return nil
+	case <-ctx.Done():
+		return ErrAckTimeout
+	}
+}
+
+func publish[E Marshaller[any]](ctx context.Context, m *MqttHydroponicClient, topic string, message E) error {
+	b, err := message.Marshall()
+	if err != nil {
+		return err
+	}
+	t := m.cli.Publish(topic, 1, false, b)
+	select {
+	case <-t.Done():
+	case <-ctx.Done():
+		return ErrPublishTimeout
+	}
 	if err := t.Error(); err != nil {
 		log.Error().Err(err).Str("topic", topic).Msg("can not send data to topic")
-	} else {
-		log.Debug().Msg("message sent")
+		return errors.Wrapf(err, "can not send data to topic %s", topic)
+	}
+	log.Debug().Str("topic", topic).Msg("message sent")
+	return nil
+}
+
+// listeners is a set of callbacks notified from the mqtt client goroutines.
+type listeners[T any] struct {
+	mu  sync.RWMutex
+	fns []func(T)
+}
+
+func (l *listeners[T]) add(fn func(T)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fns = append(l.fns, fn)
+}
+
+func (l *listeners[T]) notify(v T) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, fn := range l.fns {
+		fn(v)
+	}
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
 	}
+	return hex.EncodeToString(b)
 }
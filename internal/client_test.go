@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-playground/validator"
+	"github.com/pkg/errors"
+)
+
+// doneToken is a completed mqtt token.
+type doneToken struct{ err error }
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Error() error                   { return t.err }
+
+func (t doneToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// fakeBroker is an mqtt client that records the subscriptions and the published commands,
+// which the controller acknowledges right away, with ackErr when it is set.
+type fakeBroker struct {
+	mqtt.Client
+	topics []string
+
+	mu     sync.Mutex
+	open   bool
+	ackErr string
+	m      *MqttHydroponicClient
+	sent   []CommandMessage
+	at     []time.Time
+}
+
+func (b *fakeBroker) IsConnectionOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+func (b *fakeBroker) setOpen(open bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.open = open
+}
+
+func (b *fakeBroker) Publish(_ string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	var msg CommandMessage
+	if err := json.Unmarshal(payload.([]byte), &msg); err != nil {
+		return doneToken{err: err}
+	}
+	b.mu.Lock()
+	b.sent = append(b.sent, msg)
+	b.at = append(b.at, time.Now())
+	ackErr := b.ackErr
+	b.mu.Unlock()
+	go func() {
+		// the ack arrives once the command waits for it
+		for i := 0; i < 100; i++ {
+			b.m.mu.Lock()
+			ch := b.m.pending[msg.ID]
+			b.m.mu.Unlock()
+			if ch != nil {
+				ch <- CommandAck{ID: msg.ID, Err: ackErr}
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return doneToken{}
+}
+
+func (b *fakeBroker) published() []CommandMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]CommandMessage(nil), b.sent...)
+}
+
+func (b *fakeBroker) Subscribe(topic string, _ byte, _ mqtt.MessageHandler) mqtt.Token {
+	b.topics = append(b.topics, topic)
+	return doneToken{}
+}
+
+func TestSubscribeOrder(t *testing.T) {
+	reg, err := NewDeviceRegistry(&DeviceConfig{Discovery: true, Legacy: "tank-0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b := &fakeBroker{}
+	m := &MqttHydroponicClient{reg: reg, ackTimeout: time.Second}
+	m.subscribe(b)
+
+	want := []string{
+		"hydroponic/+/birth",
+		"hydroponic/+/status",
+		"hydroponic/+/light",
+		"hydroponic/+/error",
+		"hydroponic/+/ack",
+		"hydroponic/+/sensors",
+		"hydroponic/light",
+		"hydroponic/error",
+		"hydroponic/ack",
+		"hydroponic/sensors",
+	}
+	if len(b.topics) != len(want) {
+		t.Fatalf("subscribed to %v, want %v", b.topics, want)
+	}
+	for i := range want {
+		if b.topics[i] != want[i] {
+			t.Fatalf("subscribed to %v, want %v", b.topics, want)
+		}
+	}
+}
+
+func TestCommandParamsCheck(t *testing.T) {
+	ml := func(v float64) *float64 { return &v }
+	ms := func(v uint32) *uint32 { return &v }
+	pct := func(v uint8) *uint8 { return &v }
+	for _, tc := range []struct {
+		name  string
+		cmd   Command
+		p     CommandParams
+		valid bool
+	}{
+		{"default dose", PhUpCommand, CommandParams{}, true},
+		{"volume", PhDownCommand, CommandParams{Ml: ml(5)}, true},
+		{"run time", AddWaterCommand, CommandParams{DurationMs: ms(1000)}, true},
+		{"volume and run time", SoilCommand, CommandParams{Ml: ml(5), DurationMs: ms(1000)}, false},
+		{"volume out of range", PhUpCommand, CommandParams{Ml: ml(501)}, false},
+		{"zero volume", PhUpCommand, CommandParams{Ml: ml(0)}, false},
+		{"run time out of range", PhUpCommand, CommandParams{DurationMs: ms(99)}, false},
+		{"dose with intensity", PhUpCommand, CommandParams{Intensity: pct(50)}, false},
+		{"light on with intensity", LightOnCommand, CommandParams{Intensity: pct(50)}, true},
+		{"intensity out of range", LightOnCommand, CommandParams{Intensity: pct(101)}, false},
+		{"light on with volume", LightOnCommand, CommandParams{Ml: ml(5)}, false},
+		{"light off with intensity", LightOffCommand, CommandParams{Intensity: pct(50)}, false},
+		{"light off", LightOffCommand, CommandParams{}, true},
+		{"light change with run time", LightChangeCommand, CommandParams{DurationMs: ms(1000)}, false},
+	} {
+		err := tc.p.check(tc.cmd)
+		if tc.valid && err != nil {
+			t.Errorf("%s: rejected: %v", tc.name, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidParams) {
+			t.Errorf("%s: got %v, want ErrInvalidParams", tc.name, err)
+		}
+	}
+}
+
+func TestDoseRequestValidation(t *testing.T) {
+	v := &Validator{validator: validator.New()}
+	over := 600.0
+	if err := v.Validate(&ChangePhRequest{DoseRequest: DoseRequest{CommandParams{Ml: &over}}}); err == nil {
+		t.Error("dose over the range accepted")
+	}
+	ok := 10.0
+	if err := v.Validate(&ChangePhRequest{DoseRequest: DoseRequest{CommandParams{Ml: &ok}}}); err != nil {
+		t.Errorf("dose rejected: %v", err)
+	}
+}
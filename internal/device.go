@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrUnknownDevice is returned for a device that is not in the registry.
+var ErrUnknownDevice = errors.New("unknown device")
+
+// DeviceStatus is the presence of a device on the broker.
+type DeviceStatus string
+
+const (
+	DeviceUnknown DeviceStatus = "unknown"
+	DeviceOnline  DeviceStatus = "online"
+	DeviceOffline DeviceStatus = "offline"
+)
+
+// Device is a grow unit served by this instance.
+type Device struct {
+	ID           string       `json:"id"`
+	Firmware     string       `json:"firmware,omitempty"`
+	Capabilities []string     `json:"capabilities,omitempty"`
+	Status       DeviceStatus `json:"status"`
+	LastSeen     *time.Time   `json:"lastSeen"`
+}
+
+// DeviceBirth is the payload a controller publishes on its birth topic when it connects.
+type DeviceBirth struct {
+	Firmware     string   `json:"firmware"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// DevicePresence is the payload of the status topic, controllers set it as their Last Will
+// with the offline status so the broker publishes it when they disappear.
+type DevicePresence struct {
+	Status DeviceStatus `json:"status" validate:"oneof=online offline"`
+}
+
+// DeviceConfig structure containing the ids of the grow units known at startup,
+// with Discovery the controllers announcing themselves are registered as well.
+// Legacy names the device of the firmware publishing on the topics without a device level,
+// its queries include the data stored before readings were tagged with a device.
+type DeviceConfig struct {
+	Devices   []string
+	Discovery bool
+	Legacy    string
+}
+
+// DeviceRegistry knows the grow units served by this instance and their presence.
+type DeviceRegistry struct {
+	discovery bool
+	legacy    string
+
+	mu      sync.RWMutex
+	devices map[string]*Device
+}
+
+// NewDeviceRegistry returns a registry of the configured devices.
+func NewDeviceRegistry(cfg *DeviceConfig) (*DeviceRegistry, error) {
+	r := &DeviceRegistry{discovery: cfg.Discovery, legacy: strings.TrimSpace(cfg.Legacy), devices: make(map[string]*Device)}
+	ids := cfg.Devices
+	if r.legacy != "" {
+		ids = append(ids[:len(ids):len(ids)], r.legacy)
+	}
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if err := checkDeviceID(id); err != nil {
+			return nil, err
+		}
+		r.devices[id] = &Device{ID: id, Status: DeviceUnknown}
+	}
+	if len(r.devices) == 0 && !r.discovery {
+		return nil, errors.New("no devices configured and discovery is disabled")
+	}
+	return r, nil
+}
+
+// Legacy returns the device of the topics without a device level, empty when there is none.
+func (r *DeviceRegistry) Legacy() string {
+	return r.legacy
+}
+
+// checkDeviceID rejects ids that can not be used as a single mqtt topic level or would need
+// quoting in a query.
+func checkDeviceID(id string) error {
+	if id == "" {
+		return fmt.Errorf("invalid device id %q", id)
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return fmt.Errorf("invalid device id %q, only letters, digits, _ and - are allowed", id)
+		}
+	}
+	return nil
+}
+
+// Has reports whether the device is registered.
+func (r *DeviceRegistry) Has(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.devices[id]
+	return ok
+}
+
+// Device returns the registered device.
+func (r *DeviceRegistry) Device(id string) (Device, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.devices[id]
+	if !ok {
+		return Device{}, ErrUnknownDevice
+	}
+	return *d, nil
+}
+
+// IDs returns the sorted ids of the registered devices.
+func (r *DeviceRegistry) IDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.devices))
+	for id := range r.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Devices returns the registered devices ordered by id.
+func (r *DeviceRegistry) Devices() []Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		res = append(res, *d)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// announce records the birth of a device, unknown devices are registered when discovery is enabled.
+func (r *DeviceRegistry) announce(id string, b DeviceBirth, now time.Time, retained bool) error {
+	if err := checkDeviceID(id); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.devices[id]
+	if !ok {
+		if !r.discovery {
+			return ErrUnknownDevice
+		}
+		d = &Device{ID: id, Status: DeviceUnknown}
+		r.devices[id] = d
+		log.Info().Str("device", id).Str("firmware", b.Firmware).Msg("device discovered")
+	}
+	d.Firmware, d.Capabilities = b.Firmware, b.Capabilities
+	// a retained birth may be days old, only the status topic tells whether the device is still there
+	if !retained {
+		d.Status, d.LastSeen = DeviceOnline, &now
+	}
+	return nil
+}
+
+// seen marks the device online after it sent a message.
+func (r *DeviceRegistry) seen(id string, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d, ok := r.devices[id]; ok {
+		d.Status, d.LastSeen = DeviceOnline, &now
+	}
+}
+
+// setStatus records the presence published on the status topic, it does not count as a sign of life.
+func (r *DeviceRegistry) setStatus(id string, status DeviceStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d, ok := r.devices[id]; ok && d.Status != status {
+		log.Info().Str("device", id).Str("status", string(status)).Msg("device presence changed")
+		d.Status = status
+	}
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopicDevice(t *testing.T) {
+	for _, tc := range []struct {
+		topic  string
+		device string
+		ok     bool
+	}{
+		{"hydroponic/tank-1/sensors", "tank-1", true},
+		{deviceTopic("tank-2", mqttAckTopic), "tank-2", true},
+		{"hydroponic//sensors", "", false},
+		{"hydroponic/sensors", "", false},
+		{"other/tank-1/sensors", "", false},
+		{"hydroponic/tank-1/sensors/extra", "", false},
+	} {
+		device, ok := topicDevice(tc.topic)
+		if device != tc.device || ok != tc.ok {
+			t.Errorf("topic %q: got %q %v, want %q %v", tc.topic, device, ok, tc.device, tc.ok)
+		}
+	}
+}
+
+func TestCheckDeviceID(t *testing.T) {
+	for _, id := range []string{"tank-1", "Tank_2", "07"} {
+		if err := checkDeviceID(id); err != nil {
+			t.Errorf("id %q rejected: %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "a/b", "a+", "#", `a"b`, `a\b`, "${x}", "a.b", "a b", "tänk"} {
+		if err := checkDeviceID(id); err == nil {
+			t.Errorf("id %q accepted", id)
+		}
+	}
+}
+
+func TestLegacyDevice(t *testing.T) {
+	reg, err := NewDeviceRegistry(&DeviceConfig{Devices: []string{"tank-1"}, Legacy: "tank-0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reg.Has("tank-0") {
+		t.Fatal("legacy device is not registered")
+	}
+
+	m := &MqttHydroponicClient{reg: reg}
+	if device, ok := m.topicDevice(legacyTopic(mqttSensorTopic)); !ok || device != "tank-0" {
+		t.Errorf("legacy topic resolved to %q %v", device, ok)
+	}
+	if device, ok := m.topicDevice(deviceTopic("tank-1", mqttSensorTopic)); !ok || device != "tank-1" {
+		t.Errorf("device topic resolved to %q %v", device, ok)
+	}
+	if topic := m.commandTopic("tank-0"); topic != "hydroponic/command" {
+		t.Errorf("legacy command topic %q", topic)
+	}
+	if topic := m.commandTopic("tank-1"); topic != "hydroponic/tank-1/command" {
+		t.Errorf("device command topic %q", topic)
+	}
+
+	noLegacy := &MqttHydroponicClient{reg: &DeviceRegistry{}}
+	if _, ok := noLegacy.topicDevice(legacyTopic(mqttSensorTopic)); ok {
+		t.Error("legacy topic resolved without a legacy device")
+	}
+
+	h := &HydroponicInfluxRepo{legacy: "tank-0"}
+	if f := h.deviceFilter("tank-0"); !strings.Contains(f, "not exists r.device") {
+		t.Errorf("legacy filter %q does not include untagged points", f)
+	}
+	if f := h.deviceFilter("tank-1"); f != `r.device == "tank-1"` {
+		t.Errorf("device filter %q", f)
+	}
+}
+
+func TestDeviceRegistryPresence(t *testing.T) {
+	reg, err := NewDeviceRegistry(&DeviceConfig{Devices: []string{"tank-1"}, Discovery: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	status := func(id string) Device {
+		t.Helper()
+		d, err := reg.Device(id)
+		if err != nil {
+			t.Fatalf("device %s: %v", id, err)
+		}
+		return d
+	}
+
+	if d := status("tank-1"); d.Status != DeviceUnknown || d.LastSeen != nil {
+		t.Fatalf("configured device starts as %+v", d)
+	}
+
+	// a retained birth registers the device but is not a sign of life
+	if err := reg.announce("tank-2", DeviceBirth{Firmware: "1.2"}, now, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := status("tank-2"); d.Status != DeviceUnknown || d.LastSeen != nil || d.Firmware != "1.2" {
+		t.Errorf("retained birth gave %+v", d)
+	}
+	reg.setStatus("tank-2", DeviceOffline)
+	if d := status("tank-2"); d.Status != DeviceOffline {
+		t.Errorf("status %s after the retained offline status", d.Status)
+	}
+
+	if err := reg.announce("tank-2", DeviceBirth{Firmware: "1.3"}, now, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := status("tank-2"); d.Status != DeviceOnline || d.LastSeen == nil || !d.LastSeen.Equal(now) || d.Firmware != "1.3" {
+		t.Errorf("live birth gave %+v", d)
+	}
+
+	reg.setStatus("tank-1", DeviceOffline)
+	later := now.Add(time.Minute)
+	reg.seen("tank-1", later)
+	if d := status("tank-1"); d.Status != DeviceOnline || !d.LastSeen.Equal(later) {
+		t.Errorf("message after offline gave %+v", d)
+	}
+	// the status topic does not move the last sign of life
+	reg.setStatus("tank-1", DeviceOffline)
+	if d := status("tank-1"); d.Status != DeviceOffline || !d.LastSeen.Equal(later) {
+		t.Errorf("offline status gave %+v", d)
+	}
+
+	reg.seen("tank-9", now)
+	if reg.Has("tank-9") {
+		t.Error("a message registered an unknown device")
+	}
+	if err := reg.announce("a/b", DeviceBirth{}, now, false); err == nil {
+		t.Error("invalid id announced")
+	}
+}
+
+func TestDeviceRegistryWithoutDiscovery(t *testing.T) {
+	if _, err := NewDeviceRegistry(&DeviceConfig{}); err == nil {
+		t.Error("registry without devices and discovery accepted")
+	}
+	reg, err := NewDeviceRegistry(&DeviceConfig{Devices: []string{"tank-1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := reg.announce("tank-2", DeviceBirth{}, time.Now(), false); err != ErrUnknownDevice {
+		t.Errorf("unknown device announced with discovery off: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EventType is the kind of an Event pushed to the stream subscribers.
+type EventType string
+
+const (
+	EventSensor  EventType = "sensor"
+	EventLight   EventType = "light"
+	EventError   EventType = "error"
+	EventCommand EventType = "command"
+)
+
+const eventBuffer = 64
+
+// Event is a message pushed to the stream subscribers.
+type Event struct {
+	Type      EventType   `json:"type"`
+	Device    string      `json:"device"`
+	Timestamp time.Time   `json:"ts"`
+	Data      interface{} `json:"data"`
+}
+
+// EventHub fans out the telemetry and command results to the stream subscribers.
+type EventHub struct {
+	mu   sync.RWMutex
+	subs map[chan Event]string
+}
+
+// NewEventHub returns a hub publishing everything received from the telemetry source.
+func NewEventHub(src TelemetrySource) *EventHub {
+	h := &EventHub{subs: make(map[chan Event]string)}
+	src.OnSensorData(func(d SensorData) {
+		h.publish(Event{Type: EventSensor, Device: d.Device, Timestamp: d.Timestamp, Data: d})
+	})
+	src.OnLightState(func(ls LightState) {
+		h.publish(Event{Type: EventLight, Device: ls.Device, Timestamp: time.Now(), Data: ls})
+	})
+	src.OnDeviceError(func(e DeviceError) {
+		h.publish(Event{Type: EventError, Device: e.Device, Timestamp: e.Timestamp, Data: e})
+	})
+	src.OnCommandResult(func(r CommandResult) {
+		h.publish(Event{Type: EventCommand, Device: r.Device, Timestamp: r.Timestamp, Data: r})
+	})
+	return h
+}
+
+// Subscribe returns the channel of events of the device and the function to unsubscribe,
+// an empty device subscribes to the events of every device.
+func (h *EventHub) Subscribe(device string) (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = device
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// publish never blocks the mqtt client, events are dropped for subscribers that do not keep up.
+func (h *EventHub) publish(e Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for ch, device := range h.subs {
+		if device != "" && device != e.Device {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			log.Warn().Str("type", string(e.Type)).Msg("stream subscriber is too slow, event dropped")
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// drain returns the events buffered in ch.
+func drain(ch <-chan Event) []Event {
+	var events []Event
+	for {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventHubFilter(t *testing.T) {
+	src := &fakeTelemetry{}
+	h := NewEventHub(src)
+	one, unsubscribeOne := h.Subscribe("tank-1")
+	defer unsubscribeOne()
+	all, unsubscribeAll := h.Subscribe("")
+
+	src.sensors.notify(SensorData{Device: "tank-1"})
+	src.lights.notify(LightState{Device: "tank-2", IsUp: true})
+	src.errs.notify(DeviceError{Device: "tank-2"})
+	src.results.notify(CommandResult{Device: "tank-1", Name: "ph_up"})
+
+	got := drain(one)
+	if len(got) != 2 || got[0].Type != EventSensor || got[1].Type != EventCommand {
+		t.Errorf("device subscriber got %+v, want the sensor and command events of tank-1", got)
+	}
+	got = drain(all)
+	if len(got) != 4 || got[1].Type != EventLight || got[2].Type != EventError || got[2].Device != "tank-2" {
+		t.Errorf("subscriber of every device got %+v", got)
+	}
+
+	unsubscribeAll()
+	src.sensors.notify(SensorData{Device: "tank-1"})
+	if n := len(drain(all)); n != 0 {
+		t.Errorf("%d events after unsubscribing", n)
+	}
+}
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	src := &fakeTelemetry{}
+	h := NewEventHub(src)
+	slow, unsubscribeSlow := h.Subscribe("")
+	defer unsubscribeSlow()
+	fast, unsubscribeFast := h.Subscribe("")
+	defer unsubscribeFast()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < eventBuffer+10; i++ {
+			src.sensors.notify(SensorData{Device: "tank-1"})
+			if i == eventBuffer-1 {
+				// the fast subscriber keeps up with the first buffer
+				drain(fast)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a slow subscriber")
+	}
+	if n := len(drain(slow)); n != eventBuffer {
+		t.Errorf("slow subscriber got %d events, want the %d buffered", n, eventBuffer)
+	}
+	if n := len(drain(fast)); n != 10 {
+		t.Errorf("fast subscriber got %d events after draining, want 10", n)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	auth, err := NewAuthenticator(&AuthConfig{APIKeys: []string{"ui:viewer:secret"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reg, err := NewDeviceRegistry(&DeviceConfig{Devices: []string{"tank-1", "tank-2"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	src := &fakeTelemetry{}
+	hub := NewEventHub(src)
+	a, err := NewApp(context.Background(), AppConfig{}, auth, reg,
+		nil, nil, nil, nil, nil, nil, nil, hub, nil, nil, nil, nil, NewMetrics(&fakeTelemetry{}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv := httptest.NewServer(a.e)
+	defer srv.Close()
+
+	// the query token is only taken by the streams
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/api/devices/tank-1/events", http.StatusUnauthorized},
+		{"/api/devices/tank-1/events?access_token=wrong", http.StatusUnauthorized},
+		{"/api/devices?access_token=secret", http.StatusUnauthorized},
+	} {
+		res, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.path, res.StatusCode, tc.status)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/devices/tank-1/events?access_token=secret", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	// the handler subscribes before the headers are flushed
+	ph := 6.5
+	src.sensors.notify(SensorData{Device: "tank-2", PH: &ph})
+	src.sensors.notify(SensorData{Device: "tank-1", PH: &ph})
+	r := bufio.NewReader(res.Body)
+	var frame []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended: %v", err)
+		}
+		if line == "\n" {
+			break
+		}
+		frame = append(frame, strings.TrimSuffix(line, "\n"))
+	}
+	if len(frame) != 2 || frame[0] != "event: sensor" || !strings.HasPrefix(frame[1], "data: ") {
+		t.Fatalf("unexpected frame %q", frame)
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(frame[1], "data: ")), &e); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.Type != EventSensor || e.Device != "tank-1" {
+		t.Errorf("streamed %+v, want the sensor event of tank-1", e)
+	}
+}
@@ -2,21 +2,46 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/query"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
 	"time"
 )
 
 type HydroponicRepo interface {
-	GetLastData(ctx context.Context, start, end time.Time) ([]SensorData, error)
+	GetLastData(ctx context.Context, q DataQuery) ([]SensorData, error)
+	GetSeries(ctx context.Context, q DataQuery, field SensorField) ([]SeriesPoint, error)
+	GetLatest(ctx context.Context, device string) (LatestReadings, error)
+	WriteSensorData(ctx context.Context, d SensorData) error
+	GetDeviceErrors(ctx context.Context, q ErrorQuery) ([]DeviceError, error)
+	WriteDeviceError(ctx context.Context, e DeviceError) error
+	GetCommandAnnotations(ctx context.Context, q DataQuery) ([]CommandAnnotation, error)
+	WriteCommand(ctx context.Context, r CommandResult) error
 }
 
+// PointWriter is the part of the influx write API used by the repository.
+type PointWriter interface {
+	WritePoint(point *write.Point)
+	Flush()
+}
+
+const latestLookback = 24 * time.Hour
+
 type HydroponicInfluxRepo struct {
 	cli    influxdb2.Client
+	w      PointWriter
 	bucket string
 	org    string
+	// legacy is the device the untagged points written before the device registry belong to
+	legacy string
 }
 
 type InfluxConfig struct {
@@ -24,30 +49,121 @@ type InfluxConfig struct {
 	InfluxDBToken        string
 	InfluxDBOrganization string
 	InfluxDBBucket       string
+	BatchSize            uint
+	FlushInterval        time.Duration
+	MaxRetries           uint
+	LegacyDevice         string
 }
 
 func NewHydroponicRepo(ctx context.Context, cfg *InfluxConfig) (*HydroponicInfluxRepo, func(), error) {
-	influxClient := influxdb2.NewClient(cfg.InfluxDBURL, cfg.InfluxDBToken)
+	opts := influxdb2.DefaultOptions()
+	if cfg.BatchSize > 0 {
+		opts.SetBatchSize(cfg.BatchSize)
+	}
+	if cfg.FlushInterval > 0 {
+		opts.SetFlushInterval(uint(cfg.FlushInterval.Milliseconds()))
+	}
+	opts.SetMaxRetries(cfg.MaxRetries)
+	influxClient := influxdb2.NewClientWithOptions(cfg.InfluxDBURL, cfg.InfluxDBToken, opts)
 	s, err := influxClient.Health(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
 	log.Info().Str("health status", string(s.Status)).Msg("healthcheck influxdb")
-	h := &HydroponicInfluxRepo{influxClient, cfg.InfluxDBBucket, cfg.InfluxDBOrganization}
+
+	writeAPI := influxClient.WriteAPI(cfg.InfluxDBOrganization, cfg.InfluxDBBucket)
+	writeAPI.SetWriteFailedCallback(func(_ string, err http.Error, attempts uint) bool {
+		log.Error().Err(&err).Uint("attempts", attempts).Msg("can not write batch to influxdb")
+		return true
+	})
+	h := &HydroponicInfluxRepo{influxClient, writeAPI, cfg.InfluxDBBucket, cfg.InfluxDBOrganization, cfg.LegacyDevice}
 	return h, h.Close, nil
 }
 
-func (h *HydroponicInfluxRepo) GetLastData(ctx context.Context, start, end time.Time) ([]SensorData, error) {
-	query := fmt.Sprintf(`
+// AggregateFn is the Flux function used to downsample sensor data.
+type AggregateFn string
+
+const (
+	AggregateMean   AggregateFn = "mean"
+	AggregateMin    AggregateFn = "min"
+	AggregateMax    AggregateFn = "max"
+	AggregateLast   AggregateFn = "last"
+	AggregateMedian AggregateFn = "median"
+)
+
+// DataQuery selects sensor data of Device between Start and End, when Window is set the data is
+// aggregated into windows of that size with Fn. An empty Fields selects every reading.
+type DataQuery struct {
+	Device string
+	Start  time.Time
+	End    time.Time
+	Window time.Duration
+	Fn     AggregateFn
+	Fields []SensorField
+}
+
+var fluxEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`)
+
+// fluxString quotes s as a Flux string literal, escaping the interpolation marker as well.
+func fluxString(s string) string {
+	return `"` + fluxEscaper.Replace(s) + `"`
+}
+
+// deviceFilter is the Flux predicate selecting the points of the device,
+// the legacy device also gets the points stored without a device tag.
+func (h *HydroponicInfluxRepo) deviceFilter(device string) string {
+	if h.legacy != "" && device == h.legacy {
+		return fmt.Sprintf(`(r.device == %s or not exists r.device)`, fluxString(device))
+	}
+	return fmt.Sprintf(`r.device == %s`, fluxString(device))
+}
+
+// sensorQuery builds the Flux query selecting the sensors measurement for q.
+func (h *HydroponicInfluxRepo) sensorQuery(q DataQuery) string {
+	filter := `r._measurement == "sensors" and ` + h.deviceFilter(q.Device)
+	if len(q.Fields) > 0 {
+		fields := make([]string, 0, len(q.Fields))
+		for _, f := range q.Fields {
+			fields = append(fields, fmt.Sprintf(`r._field == "%s"`, f))
+		}
+		filter += " and (" + strings.Join(fields, " or ") + ")"
+	}
+	aggregate := ""
+	if q.Window > 0 {
+		fn := q.Fn
+		if fn == "" {
+			fn = AggregateMean
+		}
+		// the water level flag is aggregated as a 0/1 series and read back as a majority vote
+		aggregate = fmt.Sprintf(`
+		|> map(fn: (r) => ({r with _value: float(v: r._value)}))
+		|> aggregateWindow(every: %s, fn: %s, createEmpty: false)`, fluxDuration(q.Window), fn)
+	}
+	return fmt.Sprintf(`
 		from(bucket:"%s")
 		|> range(start: %s, stop: %s)
-		|> filter(fn: (r) => r._measurement == "sensors")
-	`, h.bucket, start.Format(time.RFC3339), end.Format(time.RFC3339))
+		|> filter(fn: (r) => %s)%s`,
+		h.bucket, q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), filter, aggregate)
+}
+
+// lastDataQuery selects the readings of q pivoted into one row per time.
+func (h *HydroponicInfluxRepo) lastDataQuery(q DataQuery) string {
+	return h.sensorQuery(q) + `
+		|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+		|> group()
+		|> sort(columns: ["_time"])
+	`
+}
+
+func (h *HydroponicInfluxRepo) GetLastData(ctx context.Context, q DataQuery) ([]SensorData, error) {
+	query := h.lastDataQuery(q)
 
+	ctx, span := startQuerySpan(ctx, "GetLastData", query)
+	defer span.End()
 	queryAPI := h.cli.QueryAPI(h.org)
 	result, err := queryAPI.Query(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, spanError(span, err)
 	}
 	defer func(result *api.QueryTableResult) {
 		err := result.Close()
@@ -56,39 +172,291 @@ func (h *HydroponicInfluxRepo) GetLastData(ctx context.Context, start, end time.
 		}
 	}(result)
 
-	if result.Err() != nil {
-		return nil, result.Err()
-	}
-
 	resultPoints := make([]SensorData, 0)
 
 	for result.Next() {
 		if result.TableChanged() {
 			log.Debug().Msgf("table: %s", result.TableMetadata().String())
 		}
+		resultPoints = append(resultPoints, sensorDataFromRecord(result.Record()))
+	}
+	if result.Err() != nil {
+		return nil, spanError(span, result.Err())
+	}
+
+	return resultPoints, nil
+
+}
+
+// GetSeries returns the [ts, value] series of a single field.
+func (h *HydroponicInfluxRepo) GetSeries(ctx context.Context, q DataQuery, field SensorField) ([]SeriesPoint, error) {
+	query := h.seriesQuery(q, field)
+
+	ctx, span := startQuerySpan(ctx, "GetSeries", query)
+	defer span.End()
+	result, err := h.cli.QueryAPI(h.org).Query(ctx, query)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	defer func(result *api.QueryTableResult) {
+		err := result.Close()
+		if err != nil {
+			log.Err(err)
+		}
+	}(result)
 
-		s := SensorData{Timestamp: result.Record().Time()}
-
-		switch field := result.Record().Field(); field {
-		case "ph":
-			s.PH = result.Record().Value().(float64)
-		case "light":
-			s.Light = result.Record().Value().(float64)
-		case "soil":
-			s.SoilMoisture = result.Record().Value().(float64)
-		case "lvl":
-			s.MinWaterLevel = result.Record().Value().(bool)
-		default:
-			log.Warn().Msgf("unrecognized field %s.", field)
+	series := make([]SeriesPoint, 0)
+	for result.Next() {
+		v := result.Record().Value()
+		if f, ok := v.(float64); ok && field == FieldMinWaterLevel {
+			v = f >= 0.5
 		}
+		series = append(series, SeriesPoint{Timestamp: result.Record().Time(), Value: v})
+	}
+	if result.Err() != nil {
+		return nil, spanError(span, result.Err())
+	}
+	return series, nil
+}
 
-		resultPoints = append(resultPoints, s)
+// seriesQuery selects the readings of a single field, the fields of q are ignored.
+func (h *HydroponicInfluxRepo) seriesQuery(q DataQuery, field SensorField) string {
+	q.Fields = []SensorField{field}
+	return h.sensorQuery(q) + `
+		|> group()
+		|> sort(columns: ["_time"])
+	`
+}
+
+// sensorDataFromRecord reads a pivoted record, columns of absent fields are left nil.
+func sensorDataFromRecord(r *query.FluxRecord) SensorData {
+	s := SensorData{Timestamp: r.Time()}
+	s.Device, _ = r.ValueByKey("device").(string)
+	if v, ok := r.ValueByKey("ph").(float64); ok {
+		s.PH = &v
+	}
+	if v, ok := r.ValueByKey("light").(float64); ok {
+		s.Light = &v
+	}
+	if v, ok := r.ValueByKey("soil").(float64); ok {
+		s.SoilMoisture = &v
+	}
+	switch v := r.ValueByKey("lvl").(type) {
+	case bool:
+		s.MinWaterLevel = &v
+	case float64:
+		b := v >= 0.5
+		s.MinWaterLevel = &b
 	}
+	return s
+}
 
-	return resultPoints, nil
+// fluxDuration formats d as a Flux duration literal.
+func fluxDuration(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
+// GetLatest returns the most recent value of every field of the device within the last day.
+func (h *HydroponicInfluxRepo) GetLatest(ctx context.Context, device string) (LatestReadings, error) {
+	query := fmt.Sprintf(`
+		from(bucket:"%s")
+		|> range(start: -%s)
+		|> filter(fn: (r) => r._measurement == "sensors" and %s)
+		|> last()
+	`, h.bucket, fluxDuration(latestLookback), h.deviceFilter(device))
+
+	var l LatestReadings
+	ctx, span := startQuerySpan(ctx, "GetLatest", query)
+	defer span.End()
+	result, err := h.cli.QueryAPI(h.org).Query(ctx, query)
+	if err != nil {
+		return l, spanError(span, err)
+	}
+	defer func(result *api.QueryTableResult) {
+		err := result.Close()
+		if err != nil {
+			log.Err(err)
+		}
+	}(result)
+
+	for result.Next() {
+		r := result.Record()
+		f, err := ParseSensorField(r.Field())
+		if err != nil {
+			log.Warn().Msgf("unrecognized field %s.", r.Field())
+			continue
+		}
+		l.set(f, r.Value(), r.Time())
+	}
+	if result.Err() != nil {
+		return l, spanError(span, result.Err())
+	}
+	return l, nil
+}
+
+// WriteSensorData queues the reading for the next batch, failed batches are retried by the writer.
+func (h *HydroponicInfluxRepo) WriteSensorData(_ context.Context, d SensorData) error {
+	if d.Empty() {
+		return errors.New("sensor data has no readings")
+	}
+	fields := make(map[string]interface{}, 4)
+	if d.PH != nil {
+		fields["ph"] = *d.PH
+	}
+	if d.Light != nil {
+		fields["light"] = *d.Light
+	}
+	if d.SoilMoisture != nil {
+		fields["soil"] = *d.SoilMoisture
+	}
+	if d.MinWaterLevel != nil {
+		fields["lvl"] = *d.MinWaterLevel
+	}
+	h.w.WritePoint(write.NewPoint("sensors", map[string]string{"device": d.Device}, fields, d.Timestamp))
+	return nil
+}
+
+// ErrorQuery selects a page of errors of Device between Start and End, newest first.
+type ErrorQuery struct {
+	Device string
+	Start  time.Time
+	End    time.Time
+	Limit  int
+	Offset int
+}
+
+// GetDeviceErrors returns the errors reported by the controller of the device.
+func (h *HydroponicInfluxRepo) GetDeviceErrors(ctx context.Context, q ErrorQuery) ([]DeviceError, error) {
+	query := fmt.Sprintf(`
+		from(bucket:"%s")
+		|> range(start: %s, stop: %s)
+		|> filter(fn: (r) => r._measurement == "device_errors" and %s)
+		|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+		|> group()
+		|> sort(columns: ["_time"], desc: true)
+		|> limit(n: %d, offset: %d)
+	`, h.bucket, q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), h.deviceFilter(q.Device), q.Limit, q.Offset)
+
+	ctx, span := startQuerySpan(ctx, "GetDeviceErrors", query)
+	defer span.End()
+	result, err := h.cli.QueryAPI(h.org).Query(ctx, query)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	defer func(result *api.QueryTableResult) {
+		err := result.Close()
+		if err != nil {
+			log.Err(err)
+		}
+	}(result)
+
+	errs := make([]DeviceError, 0)
+	for result.Next() {
+		r := result.Record()
+		e := DeviceError{Timestamp: r.Time()}
+		e.Device, _ = r.ValueByKey("device").(string)
+		e.Topic, _ = r.ValueByKey("topic").(string)
+		e.Err, _ = r.ValueByKey("err").(string)
+		if id, ok := r.ValueByKey("message_id").(int64); ok {
+			e.MessageID = uint16(id)
+		}
+		errs = append(errs, e)
+	}
+	if result.Err() != nil {
+		return nil, spanError(span, result.Err())
+	}
+	return errs, nil
+}
+
+// WriteDeviceError queues the error for the next batch.
+func (h *HydroponicInfluxRepo) WriteDeviceError(_ context.Context, e DeviceError) error {
+	h.w.WritePoint(write.NewPoint("device_errors",
+		map[string]string{"device": e.Device, "topic": e.Topic},
+		map[string]interface{}{"err": e.Err, "message_id": int64(e.MessageID)},
+		e.Timestamp))
+	return nil
+}
+
+// CommandAnnotation marks a command sent to the controller on the sensor charts.
+type CommandAnnotation struct {
+	Timestamp time.Time      `json:"ts"`
+	Device    string         `json:"device"`
+	Command   string         `json:"command"`
+	Outcome   CommandOutcome `json:"outcome"`
+	ID        string         `json:"id"`
+	Caller    string         `json:"caller,omitempty"`
+}
+
+// GetCommandAnnotations returns the commands sent to the device between the query bounds, oldest first.
+func (h *HydroponicInfluxRepo) GetCommandAnnotations(ctx context.Context, q DataQuery) ([]CommandAnnotation, error) {
+	query := fmt.Sprintf(`
+		from(bucket:"%s")
+		|> range(start: %s, stop: %s)
+		|> filter(fn: (r) => r._measurement == "commands" and %s)
+		|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+		|> group()
+		|> sort(columns: ["_time"])
+	`, h.bucket, q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), h.deviceFilter(q.Device))
+
+	ctx, span := startQuerySpan(ctx, "GetCommandAnnotations", query)
+	defer span.End()
+	result, err := h.cli.QueryAPI(h.org).Query(ctx, query)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	defer func(result *api.QueryTableResult) {
+		err := result.Close()
+		if err != nil {
+			log.Err(err)
+		}
+	}(result)
+
+	res := make([]CommandAnnotation, 0)
+	for result.Next() {
+		r := result.Record()
+		a := CommandAnnotation{Timestamp: r.Time()}
+		a.Device, _ = r.ValueByKey("device").(string)
+		a.Command, _ = r.ValueByKey("command").(string)
+		outcome, _ := r.ValueByKey("outcome").(string)
+		a.Outcome = CommandOutcome(outcome)
+		a.ID, _ = r.ValueByKey("id").(string)
+		a.Caller, _ = r.ValueByKey("caller").(string)
+		res = append(res, a)
+	}
+	if result.Err() != nil {
+		return nil, spanError(span, result.Err())
+	}
+	return res, nil
+}
+
+// WriteCommand queues the command as a point of the commands measurement, next to the sensors.
+func (h *HydroponicInfluxRepo) WriteCommand(_ context.Context, r CommandResult) error {
+	fields := map[string]interface{}{"id": r.ID, "caller": r.Caller}
+	if r.Err != "" {
+		fields["err"] = r.Err
+	}
+	h.w.WritePoint(write.NewPoint("commands",
+		map[string]string{"device": r.Device, "command": r.Name, "outcome": string(r.Outcome)},
+		fields,
+		r.Timestamp))
+	return nil
+}
 
+// startQuerySpan starts the client span of a Flux query.
+func startQuerySpan(ctx context.Context, op, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "influxdb "+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "influxdb"),
+			attribute.String("db.operation", op),
+			attribute.String("db.statement", query),
+		))
 }
 
 func (h *HydroponicInfluxRepo) Close() {
+	h.w.Flush()
 	h.cli.Close()
 }
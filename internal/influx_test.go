@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceFilter(t *testing.T) {
+	h := &HydroponicInfluxRepo{bucket: "hydro", legacy: "tank-0"}
+	for _, tc := range []struct {
+		device string
+		want   string
+	}{
+		{"tank-1", `r.device == "tank-1"`},
+		{"tank-0", `(r.device == "tank-0" or not exists r.device)`},
+		{`a"b`, `r.device == "a\"b"`},
+		{`a\`, `r.device == "a\\"`},
+		{`a\" or true or "`, `r.device == "a\\\" or true or \""`},
+		{"${r._value}", `r.device == "\${r._value}"`},
+		{"$x", `r.device == "$x"`},
+	} {
+		if got := h.deviceFilter(tc.device); got != tc.want {
+			t.Errorf("device %q: filter %s, want %s", tc.device, got, tc.want)
+		}
+	}
+}
+
+func TestSensorQuery(t *testing.T) {
+	h := &HydroponicInfluxRepo{bucket: "hydro"}
+	start := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	base := DataQuery{Device: "tank-1", Start: start, End: start.Add(24 * time.Hour)}
+	for _, tc := range []struct {
+		name    string
+		q       func(q DataQuery) DataQuery
+		want    []string
+		notWant []string
+	}{
+		{
+			"raw data",
+			func(q DataQuery) DataQuery { return q },
+			[]string{
+				`from(bucket:"hydro")`,
+				`range(start: 2023-05-01T00:00:00Z, stop: 2023-05-02T00:00:00Z)`,
+				`filter(fn: (r) => r._measurement == "sensors" and r.device == "tank-1")`,
+			},
+			[]string{"aggregateWindow", "map(", "r._field"},
+		},
+		{
+			"window with the default fn",
+			func(q DataQuery) DataQuery { q.Window = 5 * time.Minute; return q },
+			[]string{
+				`|> map(fn: (r) => ({r with _value: float(v: r._value)}))`,
+				`|> aggregateWindow(every: 300s, fn: mean, createEmpty: false)`,
+			},
+			nil,
+		},
+		{
+			"window with fn",
+			func(q DataQuery) DataQuery { q.Window, q.Fn = 1500*time.Millisecond, AggregateMedian; return q },
+			[]string{`|> aggregateWindow(every: 1500ms, fn: median, createEmpty: false)`},
+			nil,
+		},
+		{
+			"fields",
+			func(q DataQuery) DataQuery { q.Fields = []SensorField{FieldPH, FieldMinWaterLevel}; return q },
+			[]string{`r.device == "tank-1" and (r._field == "ph" or r._field == "lvl"))`},
+			nil,
+		},
+	} {
+		query := h.sensorQuery(tc.q(base))
+		for _, w := range tc.want {
+			if !strings.Contains(query, w) {
+				t.Errorf("%s: query misses %s:\n%s", tc.name, w, query)
+			}
+		}
+		for _, w := range tc.notWant {
+			if strings.Contains(query, w) {
+				t.Errorf("%s: query has %s:\n%s", tc.name, w, query)
+			}
+		}
+	}
+	// the map runs before the aggregation so the water level flag is averaged as 0/1,
+	// the pivot after it so every aggregated field lands in the row of its window
+	query := h.lastDataQuery(DataQuery{Device: "tank-1", Start: start, End: start, Window: time.Minute})
+	mapAt, aggregateAt, pivotAt := strings.Index(query, "map("), strings.Index(query, "aggregateWindow("), strings.Index(query, "pivot(")
+	if mapAt < 0 || mapAt > aggregateAt || aggregateAt > pivotAt {
+		t.Errorf("unexpected pipeline order:\n%s", query)
+	}
+	if !strings.Contains(query, `pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`) {
+		t.Errorf("rows are not pivoted:\n%s", query)
+	}
+}
+
+func TestSeriesQuery(t *testing.T) {
+	h := &HydroponicInfluxRepo{bucket: "hydro"}
+	start := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	q := DataQuery{Device: "tank-1", Start: start, End: start.Add(time.Hour), Fields: []SensorField{FieldPH, FieldLight}}
+	query := h.seriesQuery(q, FieldSoilMoisture)
+	if !strings.Contains(query, `r.device == "tank-1" and (r._field == "soil"))`) || strings.Contains(query, `"ph"`) {
+		t.Errorf("series query does not select the field alone:\n%s", query)
+	}
+	if strings.Contains(query, "pivot(") {
+		t.Errorf("series query is pivoted:\n%s", query)
+	}
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Ingestor writes telemetry received from the controller into the repository.
+type Ingestor struct {
+	repo HydroponicRepo
+}
+
+// NewIngestor subscribes to the telemetry source and stores every reading, device error and command result it receives.
+func NewIngestor(ctx context.Context, src TelemetrySource, repo HydroponicRepo) *Ingestor {
+	i := &Ingestor{repo: repo}
+	src.OnSensorData(func(d SensorData) {
+		i.storeSensorData(ctx, d)
+	})
+	src.OnDeviceError(func(e DeviceError) {
+		i.storeDeviceError(ctx, e)
+	})
+	src.OnCommandResult(func(r CommandResult) {
+		i.storeCommand(ctx, r)
+	})
+	return i
+}
+
+func (i *Ingestor) storeSensorData(ctx context.Context, d SensorData) {
+	if err := i.repo.WriteSensorData(ctx, d); err != nil {
+		log.Error().Err(err).Str("device", d.Device).Time("ts", d.Timestamp).Msg("can not store sensor data")
+	}
+}
+
+func (i *Ingestor) storeDeviceError(ctx context.Context, e DeviceError) {
+	if err := i.repo.WriteDeviceError(ctx, e); err != nil {
+		log.Error().Err(err).Str("device", e.Device).Str("topic", e.Topic).Msg("can not store device error")
+	}
+}
+
+func (i *Ingestor) storeCommand(ctx context.Context, r CommandResult) {
+	if err := i.repo.WriteCommand(ctx, r); err != nil {
+		log.Error().Err(err).Str("device", r.Device).Str("id", r.ID).Msg("can not store command")
+	}
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+type fakeWriter struct {
+	points  []*write.Point
+	flushes int
+}
+
+func (f *fakeWriter) WritePoint(p *write.Point) {
+	f.points = append(f.points, p)
+}
+
+func (f *fakeWriter) Flush() {
+	f.flushes++
+}
+
+type fakeTelemetry struct {
+	sensors listeners[SensorData]
+	lights  listeners[LightState]
+	errs    listeners[DeviceError]
+	results listeners[CommandResult]
+}
+
+func (f *fakeTelemetry) OnSensorData(fn func(SensorData)) {
+	f.sensors.add(fn)
+}
+
+func (f *fakeTelemetry) OnLightState(fn func(LightState)) {
+	f.lights.add(fn)
+}
+
+func (f *fakeTelemetry) OnDeviceError(fn func(DeviceError)) {
+	f.errs.add(fn)
+}
+
+func (f *fakeTelemetry) OnCommandResult(fn func(CommandResult)) {
+	f.results.add(fn)
+}
+
+func TestDecodeSensorData(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	v := validator.New()
+
+	d, err := decodeSensorData(v, []byte(`{"light":120.5,"soilMoisture":40,"pH":6.1,"minWaterLevel":true}`), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *d.PH != 6.1 || *d.Light != 120.5 || *d.SoilMoisture != 40 || !*d.MinWaterLevel {
+		t.Errorf("unexpected reading %+v", d)
+	}
+	if !d.Timestamp.Equal(now) {
+		t.Errorf("reading without timestamp stamped with %s, want %s", d.Timestamp, now)
+	}
+
+	d, err = decodeSensorData(v, []byte(`{"pH":6.1,"ts":"2023-05-01T11:00:00Z"}`), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !d.Timestamp.Equal(now.Add(-time.Hour)) {
+		t.Errorf("payload timestamp replaced with %s", d.Timestamp)
+	}
+	if d.Light != nil || d.SoilMoisture != nil || d.MinWaterLevel != nil {
+		t.Errorf("absent readings decoded as %+v", d)
+	}
+
+	for _, payload := range []string{`{}`, `{"pH":15}`, `{"soilMoisture":-1}`, `{"pH":"acid"}`, `not json`} {
+		if _, err := decodeSensorData(v, []byte(payload), now); err == nil {
+			t.Errorf("payload %s accepted", payload)
+		}
+	}
+}
+
+func TestIngestorWritesSensorData(t *testing.T) {
+	w := &fakeWriter{}
+	src := &fakeTelemetry{}
+	NewIngestor(context.Background(), src, &HydroponicInfluxRepo{w: w})
+
+	ts := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	light, soil, ph, lvl := 100.0, 35.0, 5.8, true
+	src.sensors.notify(SensorData{Device: "tank-1", Light: &light, SoilMoisture: &soil, PH: &ph, MinWaterLevel: &lvl, Timestamp: ts})
+	src.sensors.notify(SensorData{Device: "tank-1", PH: &ph, Timestamp: ts.Add(time.Minute)})
+
+	if len(w.points) != 2 {
+		t.Fatalf("got %d points, want 2", len(w.points))
+	}
+	p := w.points[0]
+	if p.Name() != "sensors" {
+		t.Errorf("measurement %q, want sensors", p.Name())
+	}
+	if !p.Time().Equal(ts) {
+		t.Errorf("point time %s, want %s", p.Time(), ts)
+	}
+	if tags := p.TagList(); len(tags) != 1 || tags[0].Key != "device" || tags[0].Value != "tank-1" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+	want := map[string]interface{}{"ph": 5.8, "light": 100.0, "soil": 35.0, "lvl": true}
+	fields := p.FieldList()
+	if len(fields) != len(want) {
+		t.Fatalf("got %d fields, want %d", len(fields), len(want))
+	}
+	for _, f := range fields {
+		if want[f.Key] != f.Value {
+			t.Errorf("field %s = %v, want %v", f.Key, f.Value, want[f.Key])
+		}
+	}
+	if fields := w.points[1].FieldList(); len(fields) != 1 || fields[0].Key != "ph" {
+		t.Errorf("partial reading written with fields %v", fields)
+	}
+}
+
+func TestIngestorWritesDeviceErrors(t *testing.T) {
+	w := &fakeWriter{}
+	src := &fakeTelemetry{}
+	NewIngestor(context.Background(), src, &HydroponicInfluxRepo{w: w})
+
+	ts := time.Date(2023, 5, 1, 3, 0, 0, 0, time.UTC)
+	topic := deviceTopic("tank-1", mqttErrorTopic)
+	src.errs.notify(DeviceError{Device: "tank-1", Topic: topic, MessageID: 7, Err: "pump stalled", Timestamp: ts})
+
+	if len(w.points) != 1 {
+		t.Fatalf("got %d points, want 1", len(w.points))
+	}
+	p := w.points[0]
+	if p.Name() != "device_errors" || !p.Time().Equal(ts) {
+		t.Errorf("unexpected point %s at %s", p.Name(), p.Time())
+	}
+	want := map[string]interface{}{"device": "tank-1", "topic": topic}
+	for _, tag := range p.TagList() {
+		if want[tag.Key] != tag.Value {
+			t.Errorf("tag %s = %v, want %v", tag.Key, tag.Value, want[tag.Key])
+		}
+	}
+	if len(p.TagList()) != len(want) {
+		t.Errorf("unexpected tags %v", p.TagList())
+	}
+	want = map[string]interface{}{"err": "pump stalled", "message_id": int64(7)}
+	for _, f := range p.FieldList() {
+		if want[f.Key] != f.Value {
+			t.Errorf("field %s = %v, want %v", f.Key, f.Value, want[f.Key])
+		}
+	}
+}
+
+func TestIngestorWritesCommands(t *testing.T) {
+	w := &fakeWriter{}
+	src := &fakeTelemetry{}
+	NewIngestor(context.Background(), src, &HydroponicInfluxRepo{w: w})
+
+	ts := time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC)
+	src.results.notify(CommandResult{
+		ID:            "c1",
+		Device:        "tank-1",
+		Command:       PhUpCommand,
+		Name:          PhUpCommand.String(),
+		Outcome:       OutcomeAcknowledged,
+		Timestamp:     ts,
+		CommandOrigin: CommandOrigin{Caller: "ph-control"},
+	})
+
+	if len(w.points) != 1 {
+		t.Fatalf("got %d points, want 1", len(w.points))
+	}
+	p := w.points[0]
+	if p.Name() != "commands" || !p.Time().Equal(ts) {
+		t.Errorf("unexpected point %s at %s", p.Name(), p.Time())
+	}
+	want := map[string]interface{}{"device": "tank-1", "command": "ph_up", "outcome": "acknowledged"}
+	for _, tag := range p.TagList() {
+		if want[tag.Key] != tag.Value {
+			t.Errorf("tag %s = %v, want %v", tag.Key, tag.Value, want[tag.Key])
+		}
+	}
+	want = map[string]interface{}{"id": "c1", "caller": "ph-control"}
+	for _, f := range p.FieldList() {
+		if want[f.Key] != f.Value {
+			t.Errorf("field %s = %v, want %v", f.Key, f.Value, want[f.Key])
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ClockTime is a time of day stored as the offset from midnight, encoded as "15:04".
+type ClockTime time.Duration
+
+func (ct *ClockTime) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil {
+		return fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return fmt.Errorf("time of day %q is out of range", s)
+	}
+	*ct = ClockTime(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+	return nil
+}
+
+func (ct ClockTime) MarshalJSON() ([]byte, error) {
+	d := time.Duration(ct)
+	return json.Marshal(fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60))
+}
+
+// LightWindow is the part of the day when the light is on, Off may be earlier than On to span midnight.
+type LightWindow struct {
+	On  ClockTime `json:"on"`
+	Off ClockTime `json:"off"`
+}
+
+func (w LightWindow) isOn(offset time.Duration) bool {
+	on, off := time.Duration(w.On), time.Duration(w.Off)
+	switch {
+	case on < off:
+		return offset >= on && offset < off
+	case on > off:
+		return offset >= on || offset < off
+	default:
+		return false
+	}
+}
+
+// GrowthStage overrides the default window from FromDay days after startup.
+type GrowthStage struct {
+	Name    string `json:"name"`
+	FromDay int    `json:"fromDay"`
+	LightWindow
+}
+
+// LightSchedule is the photoperiod program. A weekday override wins over the growth stage,
+// which wins over the default window.
+type LightSchedule struct {
+	Default  LightWindow            `json:"default"`
+	Weekdays map[string]LightWindow `json:"weekdays,omitempty"`
+	Stages   []GrowthStage          `json:"stages,omitempty"`
+}
+
+func loadLightSchedule(file string) (*LightSchedule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not read light schedule")
+	}
+	s := &LightSchedule{}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrap(err, "can not parse light schedule")
+	}
+	for day := range s.Weekdays {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return nil, fmt.Errorf("unknown weekday %q in light schedule", day)
+		}
+	}
+	for _, st := range s.Stages {
+		if st.FromDay < 0 {
+			return nil, fmt.Errorf("growth stage %q starts before startup", st.Name)
+		}
+	}
+	return s, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// window returns the light window for the day of now, startup may be zero when unknown.
+func (s *LightSchedule) window(now, startup time.Time) LightWindow {
+	for day, w := range s.Weekdays {
+		if weekdays[strings.ToLower(day)] == now.Weekday() {
+			return w
+		}
+	}
+	w := s.Default
+	if startup.IsZero() || now.Before(startup) {
+		return w
+	}
+	days := int(now.Sub(startup) / (24 * time.Hour))
+	from := -1
+	for _, st := range s.Stages {
+		if st.FromDay <= days && st.FromDay > from {
+			w, from = st.LightWindow, st.FromDay
+		}
+	}
+	return w
+}
+
+// Desired reports whether the light should be on at now.
+func (s *LightSchedule) Desired(now, startup time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	return s.window(now, startup).isOn(now.Sub(midnight))
+}
+
+// LightScheduleConfig structure containing the photoperiod engine settings.
+// ReportTimeout is how long a sent state may stay unreported before it is sent again.
+type LightScheduleConfig struct {
+	File          string
+	CheckInterval time.Duration
+	ReportTimeout time.Duration
+}
+
+// LightScheduleState is a snapshot of the photoperiod engine of a device exposed through the API.
+type LightScheduleState struct {
+	Device        string         `json:"device"`
+	Enabled       bool           `json:"enabled"`
+	Schedule      *LightSchedule `json:"schedule"`
+	Desired       *bool          `json:"desired"`
+	Reported      bool           `json:"reported"`
+	LastCommandAt *time.Time     `json:"lastCommandAt"`
+	LastError     string         `json:"lastError,omitempty"`
+}
+
+// lightTarget is what the scheduler last did on a device.
+type lightTarget struct {
+	commanded     *bool
+	lastCommandAt *time.Time
+	lastErr       error
+}
+
+// LightScheduler drives the light of every device according to the LightSchedule with explicit on/off commands.
+type LightScheduler struct {
+	sched  *LightSchedule
+	cli    HydroponicClient
+	lights LightStateSource
+	t      TimeLoader
+	reg    *DeviceRegistry
+	// reportTimeout bounds the wait for the device to report a commanded state
+	reportTimeout time.Duration
+
+	mu      sync.Mutex
+	targets map[string]*lightTarget
+}
+
+// NewLightScheduler returns a started photoperiod engine, it does nothing when no schedule file is configured.
+func NewLightScheduler(ctx context.Context, cfg *LightScheduleConfig, reg *DeviceRegistry, hc HydroponicClient, lights LightStateSource, t TimeLoader) (*LightScheduler, func(), error) {
+	ls := &LightScheduler{cli: hc, lights: lights, t: t, reg: reg, targets: make(map[string]*lightTarget)}
+	if cfg.File == "" {
+		log.Info().Msg("light schedule is not configured")
+		return ls, func() {}, nil
+	}
+	sched, err := loadLightSchedule(cfg.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	ls.sched = sched
+	interval := cfg.CheckInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ls.reportTimeout = cfg.ReportTimeout
+	if ls.reportTimeout <= 0 {
+		ls.reportTimeout = 5 * time.Minute
+	}
+	log.Debug().Interface("light schedule", sched).Msg("starting light scheduler")
+
+	ctx, cancel := context.WithCancel(WithCommandOrigin(ctx, CommandOrigin{Caller: "light-schedule"}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tk := time.NewTicker(interval)
+		defer tk.Stop()
+		ls.reconcileAll(ctx, time.Now())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-tk.C:
+				ls.reconcileAll(ctx, now)
+			}
+		}
+	}()
+	return ls, func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+func (ls *LightScheduler) startup() time.Time {
+	st, err := ls.t.GetStartupTime()
+	if err != nil {
+		log.Debug().Err(err).Msg("startup time is unknown, growth stages are ignored")
+		return time.Time{}
+	}
+	return st
+}
+
+func (ls *LightScheduler) target(device string) *lightTarget {
+	t, ok := ls.targets[device]
+	if !ok {
+		t = &lightTarget{}
+		ls.targets[device] = t
+	}
+	return t
+}
+
+func (ls *LightScheduler) reconcileAll(ctx context.Context, now time.Time) {
+	desired := ls.sched.Desired(now, ls.startup())
+	for _, device := range ls.reg.IDs() {
+		ls.reconcile(ctx, device, desired, now)
+	}
+}
+
+// reconcile sends the desired state when the reported state differs. After a sent state it waits
+// for the report up to the report timeout, so a device that reports late or never does is not
+// flooded with commands eating the safety limits. A command that was queued or not acknowledged
+// may still run, it is waited for like a sent one.
+func (ls *LightScheduler) reconcile(ctx context.Context, device string, desired bool, now time.Time) {
+	reported := ls.lights.LightState(device).IsUp
+	if reported == desired {
+		return
+	}
+
+	ls.mu.Lock()
+	t := ls.target(device)
+	commanded := t.commanded != nil && *t.commanded == desired
+	waiting := commanded && t.lastCommandAt != nil && now.Sub(*t.lastCommandAt) < ls.reportTimeout
+	ls.mu.Unlock()
+	if waiting {
+		return
+	}
+
+	log.Info().Str("device", device).Bool("desired", desired).Bool("reported", reported).Msg("light schedule switching light")
+	err := ls.cli.SetLight(ctx, device, desired)
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	t.lastCommandAt, t.lastErr = &now, err
+	if err != nil {
+		log.Error().Err(err).Str("device", device).Msg("light schedule can not switch light")
+	}
+	if !commandMayHaveRun(err) {
+		t.commanded = nil
+		return
+	}
+	t.commanded = &desired
+}
+
+// State returns the schedule with the desired and reported light state of the device.
+func (ls *LightScheduler) State(device string, now time.Time) LightScheduleState {
+	st := LightScheduleState{Device: device, Reported: ls.lights.LightState(device).IsUp}
+	if ls.sched == nil {
+		return st
+	}
+	desired := ls.sched.Desired(now, ls.startup())
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	t := ls.target(device)
+	st.Enabled, st.Schedule, st.Desired, st.LastCommandAt = true, ls.sched, &desired, t.lastCommandAt
+	if t.lastErr != nil {
+		st.LastError = t.lastErr.Error()
+	}
+	return st
+}
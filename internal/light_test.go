@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClient records the commands instead of publishing them.
+type fakeClient struct {
+	mu   sync.Mutex
+	sent []Command
+	err  error
+}
+
+func (f *fakeClient) Send(_ context.Context, _ string, cmd Command, _ CommandParams) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, cmd)
+	return f.err
+}
+
+func (f *fakeClient) SendUpPh(ctx context.Context, device string) error {
+	return f.Send(ctx, device, PhUpCommand, CommandParams{})
+}
+
+func (f *fakeClient) SendDownPh(ctx context.Context, device string) error {
+	return f.Send(ctx, device, PhDownCommand, CommandParams{})
+}
+
+func (f *fakeClient) SendAddSoil(ctx context.Context, device string) error {
+	return f.Send(ctx, device, SoilCommand, CommandParams{})
+}
+
+func (f *fakeClient) SendAddWater(ctx context.Context, device string) error {
+	return f.Send(ctx, device, AddWaterCommand, CommandParams{})
+}
+
+func (f *fakeClient) SendChangeLight(ctx context.Context, device string) error {
+	return f.Send(ctx, device, LightChangeCommand, CommandParams{})
+}
+
+func (f *fakeClient) SetLight(ctx context.Context, device string, on bool) error {
+	if on {
+		return f.Send(ctx, device, LightOnCommand, CommandParams{})
+	}
+	return f.Send(ctx, device, LightOffCommand, CommandParams{})
+}
+
+func (f *fakeClient) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sent)
+}
+
+type fakeLights map[string]bool
+
+func (f fakeLights) LightState(device string) LightState {
+	return LightState{Device: device, IsUp: f[device]}
+}
+
+func clock(h, m int) ClockTime {
+	return ClockTime(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+}
+
+func TestLightScheduleDesired(t *testing.T) {
+	s := &LightSchedule{
+		Default:  LightWindow{On: clock(6, 0), Off: clock(18, 0)},
+		Weekdays: map[string]LightWindow{"Sunday": {On: clock(8, 0), Off: clock(10, 0)}},
+		Stages:   []GrowthStage{{Name: "flower", FromDay: 10, LightWindow: LightWindow{On: clock(20, 0), Off: clock(4, 0)}}},
+	}
+	// 2023-05-01 is a monday
+	day := func(d, h, m int) time.Time { return time.Date(2023, 5, d, h, m, 0, 0, time.UTC) }
+	startup := day(1, 0, 0)
+	for _, tc := range []struct {
+		name    string
+		now     time.Time
+		startup time.Time
+		want    bool
+	}{
+		{"default before on", day(1, 5, 59), startup, false},
+		{"default on", day(1, 6, 0), startup, true},
+		{"default off is exclusive", day(1, 18, 0), startup, false},
+		{"unknown startup keeps default", day(12, 12, 0), time.Time{}, true},
+		{"stage spans midnight, evening", day(12, 22, 0), startup, true},
+		{"stage spans midnight, morning", day(12, 3, 0), startup, true},
+		{"stage off at noon", day(12, 12, 0), startup, false},
+		{"weekday override wins", day(7, 9, 0), startup, true},
+		{"weekday override off", day(7, 12, 0), startup, false},
+	} {
+		if got := s.Desired(tc.now, tc.startup); got != tc.want {
+			t.Errorf("%s: desired %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLightSchedulerReconcile(t *testing.T) {
+	cli := &fakeClient{}
+	lights := fakeLights{}
+	ls := &LightScheduler{cli: cli, lights: lights, targets: make(map[string]*lightTarget), reportTimeout: 5 * time.Minute}
+	ctx := context.Background()
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	ls.reconcile(ctx, "tank-1", true, now)
+	if cli.count() != 1 {
+		t.Fatalf("%d commands sent, want 1", cli.count())
+	}
+	// the device did not report yet, the command is not repeated before the timeout
+	ls.reconcile(ctx, "tank-1", true, now.Add(30*time.Second))
+	ls.reconcile(ctx, "tank-1", true, now.Add(4*time.Minute))
+	if cli.count() != 1 {
+		t.Fatalf("%d commands sent while waiting for the report, want 1", cli.count())
+	}
+	ls.reconcile(ctx, "tank-1", true, now.Add(5*time.Minute))
+	if cli.count() != 2 {
+		t.Fatalf("%d commands sent after the report timeout, want 2", cli.count())
+	}
+
+	lights["tank-1"] = true
+	ls.reconcile(ctx, "tank-1", true, now.Add(20*time.Minute))
+	if cli.count() != 2 {
+		t.Fatalf("%d commands sent once in sync, want 2", cli.count())
+	}
+	// a new desired state is sent right away
+	ls.reconcile(ctx, "tank-1", false, now.Add(21*time.Minute))
+	if cli.count() != 3 || cli.sent[2] != LightOffCommand {
+		t.Fatalf("commands %v, want light_off sent", cli.sent)
+	}
+
+	// a failed command is retried on the next tick
+	cli.err = ErrPublishTimeout
+	ls.reconcile(ctx, "tank-2", true, now)
+	ls.reconcile(ctx, "tank-2", true, now.Add(30*time.Second))
+	if cli.count() != 5 {
+		t.Fatalf("%d commands sent, want the failed one retried", cli.count())
+	}
+
+	// a light already in the desired state is left alone
+	cli.err = nil
+	lights["tank-3"] = true
+	ls.reconcile(ctx, "tank-3", true, now)
+	if cli.count() != 5 {
+		t.Fatalf("%d commands sent for a light in sync, want 5", cli.count())
+	}
+
+	// a command that may still run waits for the report like a sent one
+	for i, err := range []error{ErrAckTimeout, ErrCommandQueued} {
+		device := fmt.Sprintf("tank-%d", 4+i)
+		cli.err = err
+		before := cli.count()
+		ls.reconcile(ctx, device, true, now)
+		ls.reconcile(ctx, device, true, now.Add(30*time.Second))
+		ls.reconcile(ctx, device, true, now.Add(4*time.Minute))
+		if n := cli.count() - before; n != 1 {
+			t.Errorf("%v: %d commands sent while waiting for the report, want 1", err, n)
+		}
+	}
+}
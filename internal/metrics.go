@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics exports the latest readings, the light state and the command and error counters for Prometheus.
+type Metrics struct {
+	reg *prometheus.Registry
+
+	ph            *prometheus.GaugeVec
+	light         *prometheus.GaugeVec
+	soilMoisture  *prometheus.GaugeVec
+	minWaterLevel *prometheus.GaugeVec
+	lightOn       *prometheus.GaugeVec
+
+	commands        *prometheus.CounterVec
+	commandsQueued  *prometheus.CounterVec
+	publishFailures *prometheus.CounterVec
+	deviceErrors    *prometheus.CounterVec
+}
+
+// NewMetrics returns the exporter fed by the telemetry of the source.
+func NewMetrics(src TelemetrySource) *Metrics {
+	gauge := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "hydro", Name: name, Help: help}, []string{"device"})
+	}
+	m := &Metrics{
+		reg:           prometheus.NewRegistry(),
+		ph:            gauge("ph", "Latest pH reading."),
+		light:         gauge("light", "Latest light reading."),
+		soilMoisture:  gauge("soil_moisture_percent", "Latest soil moisture reading."),
+		minWaterLevel: gauge("min_water_level", "1 when the reservoir is at its minimum level."),
+		lightOn:       gauge("light_on", "1 when the device reported its light on."),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "hydro", Name: "commands_total", Help: "Commands sent to the devices by final outcome.",
+		}, []string{"device", "command", "outcome"}),
+		commandsQueued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "hydro", Name: "commands_queued_total", Help: "Commands queued in the outbox while the broker was unreachable.",
+		}, []string{"device", "command"}),
+		publishFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "hydro", Name: "command_publish_failures_total", Help: "Commands the broker did not accept.",
+		}, []string{"device", "command"}),
+		deviceErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "hydro", Name: "device_errors_total", Help: "Errors reported by the devices.",
+		}, []string{"device"}),
+	}
+	m.reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.ph, m.light, m.soilMoisture, m.minWaterLevel, m.lightOn,
+		m.commands, m.commandsQueued, m.publishFailures, m.deviceErrors,
+	)
+
+	src.OnSensorData(m.observeSensors)
+	src.OnLightState(func(ls LightState) {
+		m.lightOn.WithLabelValues(ls.Device).Set(boolValue(ls.IsUp))
+	})
+	src.OnDeviceError(func(e DeviceError) {
+		m.deviceErrors.WithLabelValues(e.Device).Inc()
+	})
+	src.OnCommandResult(func(r CommandResult) {
+		// a queued command reports again with its final outcome once replayed
+		if r.Outcome == OutcomeQueued {
+			m.commandsQueued.WithLabelValues(r.Device, r.Name).Inc()
+			return
+		}
+		m.commands.WithLabelValues(r.Device, r.Name, string(r.Outcome)).Inc()
+		if r.Outcome == OutcomePublishTimeout || r.Outcome == OutcomeFailed {
+			m.publishFailures.WithLabelValues(r.Device, r.Name).Inc()
+		}
+	})
+	return m
+}
+
+func (m *Metrics) observeSensors(d SensorData) {
+	if d.PH != nil {
+		m.ph.WithLabelValues(d.Device).Set(*d.PH)
+	}
+	if d.Light != nil {
+		m.light.WithLabelValues(d.Device).Set(*d.Light)
+	}
+	if d.SoilMoisture != nil {
+		m.soilMoisture.WithLabelValues(d.Device).Set(*d.SoilMoisture)
+	}
+	if d.MinWaterLevel != nil {
+		m.minWaterLevel.WithLabelValues(d.Device).Set(boolValue(*d.MinWaterLevel))
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{Registry: m.reg})
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsCounters(t *testing.T) {
+	src := &fakeTelemetry{}
+	m := NewMetrics(src)
+	ph, lvl := 6.2, true
+
+	src.sensors.notify(SensorData{Device: "tank-1", PH: &ph, MinWaterLevel: &lvl})
+	src.lights.notify(LightState{Device: "tank-1", IsUp: true})
+	src.errs.notify(DeviceError{Device: "tank-1"})
+	src.errs.notify(DeviceError{Device: "tank-1"})
+	for _, outcome := range []CommandOutcome{OutcomeAcknowledged, OutcomeAcknowledged, OutcomePublishTimeout, OutcomeFailed, OutcomeRejected} {
+		src.results.notify(CommandResult{Device: "tank-1", Name: "ph_up", Outcome: outcome})
+	}
+
+	for _, tc := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"ph", testutil.ToFloat64(m.ph.WithLabelValues("tank-1")), 6.2},
+		{"min water level", testutil.ToFloat64(m.minWaterLevel.WithLabelValues("tank-1")), 1},
+		{"light on", testutil.ToFloat64(m.lightOn.WithLabelValues("tank-1")), 1},
+		{"device errors", testutil.ToFloat64(m.deviceErrors.WithLabelValues("tank-1")), 2},
+		{"acknowledged", testutil.ToFloat64(m.commands.WithLabelValues("tank-1", "ph_up", string(OutcomeAcknowledged))), 2},
+		{"rejected", testutil.ToFloat64(m.commands.WithLabelValues("tank-1", "ph_up", string(OutcomeRejected))), 1},
+		{"publish failures", testutil.ToFloat64(m.publishFailures.WithLabelValues("tank-1", "ph_up")), 2},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+	// a queued command is counted once, with the outcome of its replay
+	src.results.notify(CommandResult{Device: "tank-1", Name: "add_water", Outcome: OutcomeQueued})
+	src.results.notify(CommandResult{Device: "tank-1", Name: "add_water", Outcome: OutcomeAcknowledged})
+	if n := testutil.ToFloat64(m.commands.WithLabelValues("tank-1", "add_water", string(OutcomeAcknowledged))); n != 1 {
+		t.Errorf("replayed command counted %v times, want 1", n)
+	}
+	if n := testutil.CollectAndCount(m.commands); n != 5 {
+		t.Errorf("%d command series, want 5 without a queued one", n)
+	}
+	if n := testutil.ToFloat64(m.commandsQueued.WithLabelValues("tank-1", "add_water")); n != 1 {
+		t.Errorf("queued commands: %v, want 1", n)
+	}
+	// a sensor missing from the data is left untouched
+	if n := testutil.CollectAndCount(m.light); n != 0 {
+		t.Errorf("%d light series without a light reading", n)
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	auth, err := NewAuthenticator(&AuthConfig{APIKeys: []string{"prometheus:viewer:scrape"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reg, err := NewDeviceRegistry(&DeviceConfig{Devices: []string{"tank-1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tc := range []struct {
+		public bool
+		key    string
+		status int
+	}{
+		{false, "", http.StatusUnauthorized},
+		{false, "scrape", http.StatusOK},
+		{true, "", http.StatusOK},
+	} {
+		a, err := NewApp(context.Background(), AppConfig{MetricsPublic: tc.public}, auth, reg,
+			nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, NewMetrics(&fakeTelemetry{}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tc.key != "" {
+			req.Header.Set("X-API-Key", tc.key)
+		}
+		rec := httptest.NewRecorder()
+		a.e.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("public %v key %q: status %d, want %d", tc.public, tc.key, rec.Code, tc.status)
+		}
+		if rec.Code == http.StatusOK && !strings.Contains(rec.Body.String(), "go_goroutines") {
+			t.Errorf("public %v: unexpected body %q", tc.public, rec.Body.String())
+		}
+	}
+}
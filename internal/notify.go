@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Notification is sent by the alert engine when an alert changes state or the controller reports an error.
+type Notification struct {
+	Rule      string      `json:"rule"`
+	Device    string      `json:"device,omitempty"`
+	State     AlertStatus `json:"state"`
+	Field     SensorField `json:"field,omitempty"`
+	Value     *float64    `json:"value,omitempty"`
+	Threshold *float64    `json:"threshold,omitempty"`
+	Message   string      `json:"message"`
+	Timestamp time.Time   `json:"ts"`
+}
+
+// Notifier delivers notifications to an external system.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, n Notification) error
+}
+
+// WebhookNotifier posts the notification as JSON to an URL.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, w.Client, w.URL, n)
+}
+
+// TelegramNotifier sends the notification text through a Telegram-style bot API.
+type TelegramNotifier struct {
+	BaseURL string
+	Token   string
+	ChatID  string
+	Client  *http.Client
+}
+
+func (t *TelegramNotifier) Name() string {
+	return "telegram"
+}
+
+func (t *TelegramNotifier) Notify(ctx context.Context, n Notification) error {
+	endpoint := fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimRight(t.BaseURL, "/"), t.Token)
+	err := postJSON(ctx, t.Client, endpoint, map[string]string{
+		"chat_id": t.ChatID,
+		"text":    n.Message,
+	})
+	// the request url contains the bot token, keep it out of the logs
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return errors.Wrap(urlErr.Err, "can not send telegram message")
+	}
+	return err
+}
+
+// SMTPNotifier mails the notification text, authentication is used only when Username is set.
+type SMTPNotifier struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (s *SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+// defaultSMTPTimeout bounds a delivery when the context has no deadline.
+const defaultSMTPTimeout = 30 * time.Second
+
+// Notify delivers the mail like smtp.SendMail, but the dial and the whole exchange are bound to ctx
+// so a hung server does not keep the goroutine forever.
+func (s *SMTPNotifier) Notify(ctx context.Context, n Notification) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return errors.Wrap(err, "invalid smtp server address")
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [hydro] %s %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		s.From, strings.Join(s.To, ", "), n.Rule, n.State, n.Message)
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultSMTPTimeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return errors.Wrap(err, "can not connect to smtp server")
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	// a cancelled context interrupts the exchange before the deadline
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return errors.Wrap(err, "can not start smtp session")
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("notification rejected with status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testNotification() Notification {
+	return Notification{
+		Rule:      "low-ph",
+		State:     AlertFiring,
+		Field:     FieldPH,
+		Message:   "low-ph: ph is 4.9, < 5.5",
+		Timestamp: time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	got := make(chan Notification, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("can not decode webhook body: %v", err)
+		}
+		got <- n
+	}))
+	defer srv.Close()
+
+	n := testNotification()
+	if err := (&WebhookNotifier{URL: srv.URL}).Notify(context.Background(), n); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r := <-got; r.Rule != n.Rule || r.State != n.State || r.Message != n.Message {
+		t.Errorf("webhook received %+v, want %+v", r, n)
+	}
+}
+
+func TestWebhookNotifierRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	if err := (&WebhookNotifier{URL: srv.URL}).Notify(context.Background(), testNotification()); err == nil {
+		t.Error("rejected webhook reported as delivered")
+	}
+}
+
+func TestTelegramNotifier(t *testing.T) {
+	got := make(chan map[string]string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/botsecret/sendMessage" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("can not decode telegram body: %v", err)
+		}
+		got <- body
+	}))
+	defer srv.Close()
+
+	tn := &TelegramNotifier{BaseURL: srv.URL, Token: "secret", ChatID: "42"}
+	if err := tn.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if body := <-got; body["chat_id"] != "42" || body["text"] != testNotification().Message {
+		t.Errorf("telegram received %v", body)
+	}
+}
+
+func TestTelegramNotifierHidesToken(t *testing.T) {
+	tn := &TelegramNotifier{BaseURL: "http://127.0.0.1:1", Token: "secret", ChatID: "42"}
+	err := tn.Notify(context.Background(), testNotification())
+	if err == nil {
+		t.Fatal("unreachable bot api reported as delivered")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error leaks the bot token: %v", err)
+	}
+}
+
+// smtpStandIn accepts a single mail on the loopback address host and returns its DATA section.
+func smtpStandIn(t *testing.T, host string) (string, <-chan string) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("can not listen on %s: %v", host, err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	mail := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					mail <- data.String()
+					reply("250 OK")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "AUTH"):
+				reply("235 authenticated")
+			case cmd == "DATA":
+				inData = true
+				reply("354 go ahead")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), mail
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	// the plain auth is only allowed without tls when the host is recognized as the loopback
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		addr, mail := smtpStandIn(t, host)
+
+		sn := &SMTPNotifier{Addr: addr, Username: "hydro", Password: "secret", From: "hydro@localhost", To: []string{"ops@localhost"}}
+		if err := sn.Notify(context.Background(), testNotification()); err != nil {
+			t.Fatalf("%s: unexpected error: %v", addr, err)
+		}
+		select {
+		case m := <-mail:
+			if !strings.Contains(m, "Subject: [hydro] low-ph firing") || !strings.Contains(m, testNotification().Message) {
+				t.Errorf("%s: unexpected mail:\n%s", addr, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: mail was not received", addr)
+		}
+	}
+}
+
+func TestSMTPNotifierHungServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// accepts the connection but never greets
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	sn := &SMTPNotifier{Addr: l.Addr().String(), From: "hydro@localhost", To: []string{"ops@localhost"}}
+	if err := sn.Notify(ctx, testNotification()); err == nil {
+		t.Fatal("hung smtp server reported as delivered")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("notify returned after %s, want the context deadline", d)
+	}
+}
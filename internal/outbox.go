@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrCommandQueued is returned when the broker is unreachable and the command waits in the outbox.
+	ErrCommandQueued = errors.New("command queued until the broker is reachable")
+	// ErrCommandExpired is reported for queued commands dropped because they were not sent before their expiry.
+	ErrCommandExpired = errors.New("queued command expired")
+	// ErrOutboxEntryNotFound is returned when removing a command that is no longer queued.
+	ErrOutboxEntryNotFound = errors.New("command is not queued")
+)
+
+const defaultOutboxTTL = 2 * time.Minute
+
+// OutboxConfig structure containing the outbox file and how long a queued command stays valid.
+type OutboxConfig struct {
+	File string
+	TTL  time.Duration
+}
+
+func (oc *OutboxConfig) checkConfig() error {
+	log.Debug().Msg("checking outbox config")
+
+	if oc.File == "" {
+		return errors.New("outbox file is not configured")
+	}
+	if oc.TTL <= 0 {
+		oc.TTL = defaultOutboxTTL
+	}
+	return nil
+}
+
+// OutboxEntry is a command waiting for the broker to come back.
+type OutboxEntry struct {
+	Device    string         `json:"device"`
+	Message   CommandMessage `json:"message"`
+	Name      string         `json:"name"`
+	QueuedAt  time.Time      `json:"queuedAt"`
+	ExpiresAt time.Time      `json:"expiresAt"`
+	Origin    CommandOrigin  `json:"origin"`
+}
+
+// OutboxState is the content of the outbox exposed through the API.
+type OutboxState struct {
+	Depth   int           `json:"depth"`
+	Entries []OutboxEntry `json:"entries"`
+}
+
+// Outbox is the durable queue of the commands sent while the broker is unreachable.
+// The whole queue is rewritten on every change, it only holds the commands of an outage.
+type Outbox struct {
+	path string
+	ttl  time.Duration
+
+	mu        sync.Mutex
+	entries   []OutboxEntry
+	replaying bool
+}
+
+// NewOutbox loads the commands left in the outbox by the previous run.
+func NewOutbox(cfg *OutboxConfig) (*Outbox, error) {
+	c := *cfg
+	if err := c.checkConfig(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.File), 0o755); err != nil {
+		return nil, errors.Wrap(err, "can not create outbox directory")
+	}
+	o := &Outbox{path: c.File, ttl: c.TTL}
+	b, err := os.ReadFile(c.File)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, errors.Wrap(err, "can not read outbox")
+	case len(b) > 0:
+		if err := json.Unmarshal(b, &o.entries); err != nil {
+			return nil, errors.Wrap(err, "can not decode outbox")
+		}
+	}
+	log.Info().Int("depth", len(o.entries)).Msg("outbox loaded")
+	return o, nil
+}
+
+// push queues the command, it is not queued if it can not be persisted.
+func (o *Outbox) push(device string, msg CommandMessage, origin CommandOrigin, now time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e := OutboxEntry{
+		Device:    device,
+		Message:   msg,
+		Name:      msg.Cmd.String(),
+		QueuedAt:  now,
+		ExpiresAt: now.Add(o.ttl),
+		Origin:    origin,
+	}
+	entries := append(o.entries[:len(o.entries):len(o.entries)], e)
+	if err := o.save(entries); err != nil {
+		return err
+	}
+	o.entries = entries
+	return nil
+}
+
+// Remove drops a queued command.
+func (o *Outbox) Remove(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, e := range o.entries {
+		if e.Message.ID != id {
+			continue
+		}
+		entries := append(append(make([]OutboxEntry, 0, len(o.entries)-1), o.entries[:i]...), o.entries[i+1:]...)
+		if err := o.save(entries); err != nil {
+			return err
+		}
+		o.entries = entries
+		return nil
+	}
+	return ErrOutboxEntryNotFound
+}
+
+// take dequeues the command before it is replayed. Unlike Remove it drops the command from memory even
+// when the outbox can not be persisted, so a replay never publishes it twice.
+func (o *Outbox) take(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, e := range o.entries {
+		if e.Message.ID != id {
+			continue
+		}
+		o.entries = append(append(make([]OutboxEntry, 0, len(o.entries)-1), o.entries[:i]...), o.entries[i+1:]...)
+		return o.save(o.entries)
+	}
+	return ErrOutboxEntryNotFound
+}
+
+// Len returns the number of queued commands.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries)
+}
+
+// State returns the queued commands of the device in replay order, every device when it is empty.
+func (o *Outbox) State(device string) OutboxState {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := OutboxState{Entries: []OutboxEntry{}}
+	for _, e := range o.entries {
+		if device == "" || e.Device == device {
+			s.Entries = append(s.Entries, e)
+		}
+	}
+	s.Depth = len(s.Entries)
+	return s
+}
+
+// startReplay marks the replay as running, it reports false if it already runs or nothing is queued.
+func (o *Outbox) startReplay() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.replaying || len(o.entries) == 0 {
+		return false
+	}
+	o.replaying = true
+	return true
+}
+
+// next returns the oldest command, the replay ends once the outbox is empty.
+func (o *Outbox) next() (OutboxEntry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.entries) == 0 {
+		o.replaying = false
+		return OutboxEntry{}, false
+	}
+	return o.entries[0], true
+}
+
+func (o *Outbox) stopReplay() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.replaying = false
+}
+
+// save replaces the outbox file.
+func (o *Outbox) save(entries []OutboxEntry) error {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "can not encode outbox")
+	}
+	return errors.Wrap(writeFileAtomic(o.path, b), "can not write outbox")
+}
+
+// writeFileAtomic replaces the file through a synced temporary file, the rename keeps the previous content if writing fails.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func newTestOutbox(t *testing.T, ttl time.Duration) (*Outbox, string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "outbox", "outbox.json")
+	o, err := NewOutbox(&OutboxConfig{File: file, TTL: ttl})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return o, file
+}
+
+func outboxIDs(entries []OutboxEntry) []string {
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.Message.ID)
+	}
+	return ids
+}
+
+func TestOutboxPersistence(t *testing.T) {
+	o, file := newTestOutbox(t, time.Minute)
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, device := range []string{"tank-1", "tank-2", "tank-1"} {
+		msg := CommandMessage{ID: string(rune('a' + i)), Cmd: PhUpCommand}
+		if err := o.push(device, msg, CommandOrigin{Caller: "ops"}, now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if ids := outboxIDs(o.State("tank-1").Entries); len(ids) != 2 || ids[0] != "a" || ids[1] != "c" {
+		t.Errorf("device state %v, want [a c]", ids)
+	}
+
+	reloaded, err := NewOutbox(&OutboxConfig{File: file})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	st := reloaded.State("")
+	if ids := outboxIDs(st.Entries); st.Depth != 3 || ids[0] != "a" || ids[1] != "b" || ids[2] != "c" {
+		t.Fatalf("reloaded %v, want [a b c]", ids)
+	}
+	e := st.Entries[0]
+	if !e.ExpiresAt.Equal(now.Add(time.Minute)) || e.Name != "ph_up" || e.Origin.Caller != "ops" {
+		t.Errorf("reloaded entry %+v", e)
+	}
+
+	if err := o.Remove("b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := o.Remove("b"); err != ErrOutboxEntryNotFound {
+		t.Errorf("removing twice: %v", err)
+	}
+	reloaded, err = NewOutbox(&OutboxConfig{File: file})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := outboxIDs(reloaded.State("").Entries); len(ids) != 2 || ids[0] != "a" || ids[1] != "c" {
+		t.Errorf("reloaded after remove %v, want [a c]", ids)
+	}
+}
+
+func TestOutboxReplayHandshake(t *testing.T) {
+	o, _ := newTestOutbox(t, time.Minute)
+	if o.startReplay() {
+		t.Fatal("replay started on an empty outbox")
+	}
+	if err := o.push("tank-1", CommandMessage{ID: "a"}, CommandOrigin{}, time.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !o.startReplay() {
+		t.Fatal("replay not started")
+	}
+	if o.startReplay() {
+		t.Fatal("second replay started")
+	}
+	if e, ok := o.next(); !ok || e.Message.ID != "a" {
+		t.Fatalf("next returned %v %v", e.Message.ID, ok)
+	}
+	if err := o.take("a"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := o.next(); ok {
+		t.Fatal("next returned a taken entry")
+	}
+	// the empty outbox ended the replay
+	if err := o.push("tank-1", CommandMessage{ID: "b"}, CommandOrigin{}, time.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !o.startReplay() {
+		t.Error("replay not started again")
+	}
+	o.stopReplay()
+	if !o.startReplay() {
+		t.Error("replay not started after stop")
+	}
+}
+
+func TestOutboxTakeUnpersisted(t *testing.T) {
+	o, _ := newTestOutbox(t, time.Minute)
+	if err := o.push("tank-1", CommandMessage{ID: "a"}, CommandOrigin{}, time.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.path = filepath.Join(t.TempDir(), "missing", "outbox.json")
+	if err := o.take("a"); err == nil {
+		t.Fatal("write to a missing directory succeeded")
+	}
+	if o.Len() != 0 {
+		t.Error("entry kept after take")
+	}
+	if err := o.take("a"); err != ErrOutboxEntryNotFound {
+		t.Errorf("taking twice: %v", err)
+	}
+}
+
+// replayHarness is a client with an outbox on a broker that starts disconnected.
+type replayHarness struct {
+	m      *MqttHydroponicClient
+	broker *fakeBroker
+
+	mu      sync.Mutex
+	results []CommandResult
+}
+
+func newReplayHarness(t *testing.T, ttl time.Duration) *replayHarness {
+	t.Helper()
+	o, _ := newTestOutbox(t, ttl)
+	reg, err := NewDeviceRegistry(&DeviceConfig{Devices: []string{"tank-1", "tank-2"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h := &replayHarness{broker: &fakeBroker{}}
+	h.m = &MqttHydroponicClient{cli: h.broker, reg: reg, outbox: o, ackTimeout: time.Second, pending: make(map[string]chan CommandAck)}
+	h.broker.m = h.m
+	h.m.OnCommandResult(func(r CommandResult) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.results = append(h.results, r)
+	})
+	return h
+}
+
+func (h *replayHarness) queue(t *testing.T, device string, cmd Command) {
+	t.Helper()
+	if err := h.m.Send(context.Background(), device, cmd, CommandParams{}); !errors.Is(err, ErrCommandQueued) {
+		t.Fatalf("got %v, want the command queued", err)
+	}
+}
+
+func (h *replayHarness) replaying() bool {
+	o := h.m.outbox
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries) > 0 || o.replaying
+}
+
+// replay reconnects and waits for the outbox to be replayed, the replay ends after the last result.
+func (h *replayHarness) replay(t *testing.T) map[CommandOutcome]int {
+	t.Helper()
+	h.broker.setOpen(true)
+	h.m.replayOutbox()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.replaying() {
+		if time.Now().After(deadline) {
+			t.Fatal("outbox was not replayed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	outcomes := make(map[CommandOutcome]int)
+	for _, r := range h.results {
+		outcomes[r.Outcome]++
+	}
+	return outcomes
+}
+
+func TestReplayOrder(t *testing.T) {
+	h := newReplayHarness(t, time.Minute)
+	h.queue(t, "tank-1", PhUpCommand)
+	h.queue(t, "tank-2", AddWaterCommand)
+	h.queue(t, "tank-1", PhDownCommand)
+	h.queue(t, "tank-1", SoilCommand)
+	// the second one is stale by the time the broker is back
+	h.m.outbox.mu.Lock()
+	h.m.outbox.entries[1].ExpiresAt = time.Now().Add(-time.Second)
+	h.m.outbox.mu.Unlock()
+
+	outcomes := h.replay(t)
+	sent := h.broker.published()
+	if len(sent) != 3 || sent[0].Cmd != PhUpCommand || sent[1].Cmd != PhDownCommand || sent[2].Cmd != SoilCommand {
+		t.Fatalf("published %v, want ph_up, ph_down, soil", sent)
+	}
+	if outcomes[OutcomeQueued] != 4 || outcomes[OutcomeAcknowledged] != 3 || outcomes[OutcomeExpired] != 1 {
+		t.Errorf("outcomes %v", outcomes)
+	}
+
+	// a command sent once the outbox is empty goes out directly
+	if err := h.m.SendUpPh(context.Background(), "tank-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := len(h.broker.published()); n != 4 {
+		t.Errorf("%d commands published, want 4", n)
+	}
+}
+
+func TestReplayNeverRepeats(t *testing.T) {
+	h := newReplayHarness(t, time.Minute)
+	h.queue(t, "tank-1", PhUpCommand)
+	h.queue(t, "tank-1", PhDownCommand)
+	// the outbox can not be rewritten anymore
+	h.m.outbox.path = filepath.Join(t.TempDir(), "missing", "outbox.json")
+
+	outcomes := h.replay(t)
+	if n := len(h.broker.published()); n != 0 {
+		t.Errorf("%d commands published without removing them from the outbox", n)
+	}
+	if outcomes[OutcomeFailed] != 2 {
+		t.Errorf("outcomes %v, want both commands failed", outcomes)
+	}
+	h.m.replayOutbox()
+	time.Sleep(20 * time.Millisecond)
+	if n := len(h.broker.published()); n != 0 {
+		t.Errorf("%d commands published by a second replay", n)
+	}
+}
+
+func TestReplaySpacing(t *testing.T) {
+	h := newReplayHarness(t, time.Minute)
+	h.m.setReplaySpacing(func(cmd Command) time.Duration {
+		if cmd == PhUpCommand {
+			return 100 * time.Millisecond
+		}
+		return 0
+	})
+	h.queue(t, "tank-1", PhUpCommand)
+	h.queue(t, "tank-1", PhDownCommand)
+	h.queue(t, "tank-1", PhUpCommand)
+	h.queue(t, "tank-2", PhUpCommand)
+
+	h.replay(t)
+	sent := h.broker.published()
+	if len(sent) != 4 {
+		t.Fatalf("published %v", sent)
+	}
+	h.broker.mu.Lock()
+	gap := h.broker.at[2].Sub(h.broker.at[0])
+	h.broker.mu.Unlock()
+	if gap < 100*time.Millisecond {
+		t.Errorf("ph_up replayed %s after the previous one, want at least 100ms", gap)
+	}
+
+	// a command that would expire while waiting is dropped
+	h = newReplayHarness(t, 50*time.Millisecond)
+	h.m.setReplaySpacing(func(Command) time.Duration { return time.Hour })
+	h.queue(t, "tank-1", PhUpCommand)
+	h.queue(t, "tank-1", PhUpCommand)
+	outcomes := h.replay(t)
+	if n := len(h.broker.published()); n != 1 || outcomes[OutcomeExpired] != 1 {
+		t.Errorf("%d published, outcomes %v", n, outcomes)
+	}
+}
+
+func TestReplayStopsOnDrain(t *testing.T) {
+	h := newReplayHarness(t, time.Minute)
+	h.m.setReplaySpacing(func(Command) time.Duration { return 50 * time.Millisecond })
+	h.queue(t, "tank-1", PhUpCommand)
+	h.queue(t, "tank-1", PhUpCommand)
+	h.queue(t, "tank-1", PhUpCommand)
+
+	h.broker.setOpen(true)
+	h.m.replayOutbox()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.broker.published()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("outbox was not replayed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the replay waits for the spacing, the drain does not wait for it
+	if err := h.m.Drain(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sent := len(h.broker.published())
+	time.Sleep(150 * time.Millisecond)
+	if n := len(h.broker.published()); n != sent {
+		t.Errorf("%d commands published after the drain", n-sent)
+	}
+	if n := h.m.outbox.Len(); n != 3-sent {
+		t.Errorf("%d commands left in the outbox, want %d", n, 3-sent)
+	}
+	h.m.outbox.mu.Lock()
+	running := h.m.outbox.replaying
+	h.m.outbox.mu.Unlock()
+	if running {
+		t.Error("replay still running after the drain")
+	}
+}
@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// PhSource provides the most recent pH reading of a device.
+type PhSource interface {
+	LatestPh(ctx context.Context, device string) (float64, time.Time, error)
+}
+
+// PhAction is the outcome of a single control loop step.
+type PhAction string
+
+const (
+	PhActionNone PhAction = "none"
+	PhActionUp   PhAction = "up"
+	PhActionDown PhAction = "down"
+	PhActionSkip PhAction = "skip"
+)
+
+const maxPhDecisions = 50
+
+// PhControlConfig structure containing the pH control loop settings.
+type PhControlConfig struct {
+	Enabled         bool
+	Target          float64
+	Deadband        float64
+	CheckInterval   time.Duration
+	MaxDosesPerHour int
+	MinDoseInterval time.Duration
+	SettlingTime    time.Duration
+	MaxReadingAge   time.Duration
+	// DoseMl is the volume of a dose, zero keeps the controller default.
+	DoseMl float64
+}
+
+func (pc *PhControlConfig) checkConfig() error {
+	log.Debug().Msg("checking ph control config")
+
+	if pc.Target <= 0 || pc.Target >= 14 {
+		return fmt.Errorf("ph target %.2f is out of range", pc.Target)
+	}
+	if pc.Deadband <= 0 {
+		return fmt.Errorf("ph deadband must be positive, got %.2f", pc.Deadband)
+	}
+	if pc.CheckInterval <= 0 {
+		pc.CheckInterval = time.Minute
+	}
+	if pc.MaxDosesPerHour <= 0 {
+		pc.MaxDosesPerHour = 4
+	}
+	if pc.MaxReadingAge <= 0 {
+		pc.MaxReadingAge = 10 * time.Minute
+	}
+	if pc.DoseMl != 0 {
+		ml := pc.DoseMl
+		if err := (CommandParams{Ml: &ml}).check(PhUpCommand); err != nil {
+			return errors.Wrap(err, "ph dose")
+		}
+	}
+	return nil
+}
+
+// PhDecision describes what the control loop did on a step and why.
+type PhDecision struct {
+	Device string    `json:"device"`
+	Time   time.Time `json:"time"`
+	Ph     *float64  `json:"ph"`
+	Action PhAction  `json:"action"`
+	Reason string    `json:"reason"`
+	Err    string    `json:"err,omitempty"`
+}
+
+// PhControlState is a snapshot of the control loop exposed through the API.
+type PhControlState struct {
+	Device        string       `json:"device"`
+	Enabled       bool         `json:"enabled"`
+	Target        float64      `json:"target"`
+	Low           float64      `json:"low"`
+	High          float64      `json:"high"`
+	LastPh        *float64     `json:"lastPh"`
+	LastReadingAt *time.Time   `json:"lastReadingAt"`
+	LastDoseAt    *time.Time   `json:"lastDoseAt"`
+	DosesLastHour int          `json:"dosesLastHour"`
+	Decisions     []PhDecision `json:"decisions"`
+}
+
+// phLoop is the control loop state of a single device.
+type phLoop struct {
+	enabled       bool
+	lastPh        *float64
+	lastReadingAt *time.Time
+	doses         []time.Time
+	decisions     []PhDecision
+}
+
+// PhController keeps pH of every device inside the configured band by dosing up or down through the HydroponicClient.
+type PhController struct {
+	cfg PhControlConfig
+	cli HydroponicClient
+	src PhSource
+	reg *DeviceRegistry
+
+	mu    sync.Mutex
+	loops map[string]*phLoop
+}
+
+// NewPhController returns a started pH control loop, the cleanup function stops it.
+func NewPhController(ctx context.Context, cfg *PhControlConfig, reg *DeviceRegistry, hc HydroponicClient, src PhSource) (*PhController, func(), error) {
+	c := *cfg
+	if err := c.checkConfig(); err != nil {
+		return nil, nil, err
+	}
+	log.Debug().Interface("ph control config", c).Msg("starting ph control loop")
+
+	p := &PhController{cfg: c, cli: hc, src: src, reg: reg, loops: make(map[string]*phLoop)}
+	for _, device := range reg.IDs() {
+		p.loops[device] = &phLoop{enabled: c.Enabled}
+	}
+
+	ctx, cancel := context.WithCancel(WithCommandOrigin(ctx, CommandOrigin{Caller: "ph-control"}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(ctx)
+	}()
+	return p, func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+func (p *PhController) run(ctx context.Context) {
+	t := time.NewTicker(p.cfg.CheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			for _, device := range p.reg.IDs() {
+				p.step(ctx, device, now)
+			}
+		}
+	}
+}
+
+// loop returns the state of the device, creating it for devices registered after startup.
+func (p *PhController) loop(device string) *phLoop {
+	l, ok := p.loops[device]
+	if !ok {
+		l = &phLoop{enabled: p.cfg.Enabled}
+		p.loops[device] = l
+	}
+	return l
+}
+
+func (p *PhController) step(ctx context.Context, device string, now time.Time) {
+	p.mu.Lock()
+	enabled := p.loop(device).enabled
+	p.mu.Unlock()
+	if !enabled {
+		return
+	}
+
+	ph, ts, err := p.src.LatestPh(ctx, device)
+	d, dose := p.decide(device, now, ph, ts, err)
+	var doseErr error
+	if dose != nil {
+		if doseErr = dose(ctx, device); doseErr != nil {
+			log.Error().Err(doseErr).Str("device", device).Str("action", string(d.Action)).Msg("ph control loop can not dose")
+			d.Err = doseErr.Error()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := p.loop(device)
+	// a refused dose did not run, it must not hold the next one back
+	if dose != nil && commandMayHaveRun(doseErr) {
+		l.doses = append(l.doses, now)
+	}
+	l.record(d)
+}
+
+// decide picks the action for the reading, the returned call sends the dose if one is due.
+func (p *PhController) decide(device string, now time.Time, ph float64, ts time.Time, err error) (PhDecision, func(context.Context, string) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := p.loop(device)
+
+	d := PhDecision{Device: device, Time: now, Action: PhActionSkip}
+	if err != nil {
+		d.Reason = "no ph reading"
+		d.Err = err.Error()
+		return d, nil
+	}
+	d.Ph = &ph
+	l.lastPh, l.lastReadingAt = &ph, &ts
+
+	if now.Sub(ts) > p.cfg.MaxReadingAge {
+		d.Reason = fmt.Sprintf("reading is stale, taken at %s", ts.Format(time.RFC3339))
+		return d, nil
+	}
+	last := l.lastDose()
+	if last != nil && ts.Before(last.Add(p.cfg.SettlingTime)) {
+		d.Reason = "waiting for the solution to settle after the last dose"
+		return d, nil
+	}
+
+	var cmd Command
+	switch {
+	case ph < p.cfg.Target-p.cfg.Deadband:
+		d.Action, cmd = PhActionUp, PhUpCommand
+	case ph > p.cfg.Target+p.cfg.Deadband:
+		d.Action, cmd = PhActionDown, PhDownCommand
+	default:
+		d.Action, d.Reason = PhActionNone, "ph is within the target band"
+		return d, nil
+	}
+
+	if n := l.dosesSince(now.Add(-time.Hour)); n >= p.cfg.MaxDosesPerHour {
+		d.Action, d.Reason = PhActionSkip, fmt.Sprintf("hourly dose limit of %d reached", p.cfg.MaxDosesPerHour)
+		return d, nil
+	}
+	if last != nil && now.Sub(*last) < p.cfg.MinDoseInterval {
+		d.Action, d.Reason = PhActionSkip, "minimum interval between doses not elapsed"
+		return d, nil
+	}
+
+	d.Reason = fmt.Sprintf("ph %.2f is outside %.2f..%.2f", ph, p.cfg.Target-p.cfg.Deadband, p.cfg.Target+p.cfg.Deadband)
+	return d, p.dose(cmd)
+}
+
+// dose returns the call sending cmd with the configured volume.
+func (p *PhController) dose(cmd Command) func(context.Context, string) error {
+	var params CommandParams
+	if p.cfg.DoseMl > 0 {
+		ml := p.cfg.DoseMl
+		params.Ml = &ml
+	}
+	return func(ctx context.Context, device string) error {
+		return p.cli.Send(ctx, device, cmd, params)
+	}
+}
+
+func (l *phLoop) record(d PhDecision) {
+	log.Debug().Interface("decision", d).Msg("ph control loop step")
+	l.decisions = append(l.decisions, d)
+	if len(l.decisions) > maxPhDecisions {
+		l.decisions = l.decisions[len(l.decisions)-maxPhDecisions:]
+	}
+}
+
+func (l *phLoop) lastDose() *time.Time {
+	if len(l.doses) == 0 {
+		return nil
+	}
+	return &l.doses[len(l.doses)-1]
+}
+
+// dosesSince counts doses after since and forgets the older ones.
+func (l *phLoop) dosesSince(since time.Time) int {
+	i := 0
+	for i < len(l.doses)-1 && l.doses[i].Before(since) {
+		i++
+	}
+	l.doses = l.doses[i:]
+	n := 0
+	for _, t := range l.doses {
+		if !t.Before(since) {
+			n++
+		}
+	}
+	return n
+}
+
+// SetEnabled turns the control loop of the device on or off.
+func (p *PhController) SetEnabled(device string, enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	log.Info().Str("device", device).Bool("enabled", enabled).Msg("ph control loop switched")
+	p.loop(device).enabled = enabled
+}
+
+// State returns the current state of the control loop of the device and its last decisions.
+func (p *PhController) State(device string, now time.Time) PhControlState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := p.loop(device)
+
+	decisions := make([]PhDecision, len(l.decisions))
+	copy(decisions, l.decisions)
+	return PhControlState{
+		Device:        device,
+		Enabled:       l.enabled,
+		Target:        p.cfg.Target,
+		Low:           p.cfg.Target - p.cfg.Deadband,
+		High:          p.cfg.Target + p.cfg.Deadband,
+		LastPh:        l.lastPh,
+		LastReadingAt: l.lastReadingAt,
+		LastDoseAt:    l.lastDose(),
+		DosesLastHour: l.dosesSince(now.Add(-time.Hour)),
+		Decisions:     decisions,
+	}
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestPhController() *PhController {
+	return &PhController{
+		cfg: PhControlConfig{
+			Enabled:         true,
+			Target:          6.0,
+			Deadband:        0.3,
+			MaxDosesPerHour: 2,
+			MinDoseInterval: 10 * time.Minute,
+			SettlingTime:    5 * time.Minute,
+			MaxReadingAge:   10 * time.Minute,
+		},
+		loops: make(map[string]*phLoop),
+	}
+}
+
+func TestPhControllerDecideBand(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		ph     float64
+		action PhAction
+	}{
+		{5.5, PhActionUp},
+		{5.7, PhActionNone},
+		{6.0, PhActionNone},
+		{6.3, PhActionNone},
+		{6.5, PhActionDown},
+	} {
+		p := newTestPhController()
+		d, dose := p.decide("tank-1", now, tc.ph, now, nil)
+		if d.Action != tc.action {
+			t.Errorf("ph %.1f: action %s, want %s", tc.ph, d.Action, tc.action)
+		}
+		if (dose != nil) != (tc.action == PhActionUp || tc.action == PhActionDown) {
+			t.Errorf("ph %.1f: unexpected dose %v", tc.ph, dose != nil)
+		}
+	}
+}
+
+// fakePh serves a fixed pH reading.
+type fakePh struct {
+	ph  float64
+	ts  time.Time
+	err error
+}
+
+func (f *fakePh) LatestPh(context.Context, string) (float64, time.Time, error) {
+	return f.ph, f.ts, f.err
+}
+
+func TestPhControllerStepSkips(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	src := &fakePh{}
+	cli := &fakeClient{}
+	p := newTestPhController()
+	p.src, p.cli = src, cli
+	// step reads a pH of 5 taken at +m and reports whether a dose was sent
+	step := func(device string, m time.Duration) bool {
+		t.Helper()
+		src.ph, src.ts, src.err = 5.0, now.Add(m), nil
+		before := cli.count()
+		p.step(ctx, device, now.Add(m))
+		return cli.count() > before
+	}
+
+	src.err = errors.New("no data")
+	p.step(ctx, "tank-1", now)
+	if d := p.State("tank-1", now).Decisions[0]; d.Action != PhActionSkip || cli.count() != 0 {
+		t.Errorf("missing reading: %+v", d)
+	}
+	src.ph, src.ts, src.err = 5.0, now.Add(-11*time.Minute), nil
+	p.step(ctx, "tank-1", now)
+	if d := p.State("tank-1", now).Decisions[1]; d.Action != PhActionSkip || cli.count() != 0 {
+		t.Errorf("stale reading: %+v", d)
+	}
+
+	// a dose, then readings taken while the solution settles are ignored
+	if !step("tank-1", 0) {
+		t.Fatal("first dose was not sent")
+	}
+	if step("tank-1", time.Minute) {
+		t.Error("dosed while settling")
+	}
+	// settled but the minimum interval did not elapse
+	if step("tank-1", 6*time.Minute) {
+		t.Error("dosed before the minimum interval")
+	}
+	if !step("tank-1", 10*time.Minute) {
+		t.Fatal("second dose was not sent")
+	}
+	// the hourly limit of 2 is reached
+	if step("tank-1", 30*time.Minute) {
+		t.Error("dosed over the hourly limit")
+	}
+	if !step("tank-1", 61*time.Minute) {
+		t.Error("dose was not sent once the first one left the hourly window")
+	}
+
+	// the limits are per device
+	if !step("tank-2", 30*time.Minute) {
+		t.Error("limits of another device applied")
+	}
+}
+
+func TestPhControllerRefusedDose(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		err     error
+		counted bool
+	}{
+		{&SafetyError{Err: ErrRateLimited, Reason: "cooldown"}, false},
+		{ErrClientClosing, false},
+		{ErrUnknownDevice, false},
+		{ErrInvalidParams, false},
+		{ErrPublishTimeout, false},
+		{ErrAckTimeout, true},
+		{ErrCommandQueued, true},
+	} {
+		cli := &fakeClient{err: tc.err}
+		p := newTestPhController()
+		p.src, p.cli = &fakePh{ph: 5.0, ts: now}, cli
+		p.step(ctx, "tank-1", now)
+		st := p.State("tank-1", now)
+		if st.Decisions[0].Err == "" {
+			t.Errorf("%v: decision without the error", tc.err)
+		}
+		if counted := st.DosesLastHour == 1; counted != tc.counted {
+			t.Errorf("%v: dose counted %v, want %v", tc.err, counted, tc.counted)
+		}
+		// a refused dose is retried on the next step
+		p.src = &fakePh{ph: 5.0, ts: now.Add(time.Minute)}
+		p.step(ctx, "tank-1", now.Add(time.Minute))
+		if retried := cli.count() == 2; retried == tc.counted {
+			t.Errorf("%v: retried %v", tc.err, retried)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+)
+
+// trustedProxies are the networks whose forwarding headers are believed.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies accepts addresses and CIDR ranges.
+func parseTrustedProxies(entries []string) (trustedProxies, error) {
+	var nets trustedProxies
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (t trustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the caller. The forwarding headers are only read when the request
+// comes from a trusted proxy, X-Forwarded-For is walked from the right so a client can not prepend
+// addresses of its choosing.
+func (t trustedProxies) clientIP(req *http.Request) string {
+	peer := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !t.trusts(peer) {
+		return peer
+	}
+	if xff := req.Header.Get(echo.HeaderXForwardedFor); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if !t.trusts(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+	if ip := strings.TrimSpace(req.Header.Get(echo.HeaderXRealIP)); ip != "" {
+		return ip
+	}
+	return peer
+}
+
+// remoteIP returns the caller address resolved by the context middleware.
+func remoteIP(c echo.Context) string {
+	if cc, ok := c.(*Context); ok && cc.RemoteIP != "" {
+		return cc.RemoteIP
+	}
+	return trustedProxies(nil).clientIP(c.Request())
+}
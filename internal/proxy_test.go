@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", " 192.168.1.1 ", ""})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		remote string
+		xff    string
+		realIP string
+		want   string
+	}{
+		{"direct", "203.0.113.5:4000", "", "", "203.0.113.5"},
+		{"spoofed by a client", "203.0.113.5:4000", "1.2.3.4", "5.6.7.8", "203.0.113.5"},
+		{"through a proxy", "10.0.0.2:4000", "203.0.113.5", "", "203.0.113.5"},
+		{"client prepends an address", "10.0.0.2:4000", "1.2.3.4, 203.0.113.5", "", "203.0.113.5"},
+		{"chain of proxies", "10.0.0.2:4000", "203.0.113.5, 192.168.1.1, 10.1.1.1", "", "203.0.113.5"},
+		{"only proxies", "10.0.0.2:4000", "10.1.1.1", "", "10.1.1.1"},
+		{"real ip from a proxy", "192.168.1.1:4000", "", "203.0.113.5", "203.0.113.5"},
+		{"proxy without headers", "10.0.0.2:4000", "", "", "10.0.0.2"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, tc.xff)
+		}
+		if tc.realIP != "" {
+			req.Header.Set(echo.HeaderXRealIP, tc.realIP)
+		}
+		if got := proxies.clientIP(req); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "proxy.local"} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("trusted proxy %q accepted", entry)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrRateLimited is returned when a command exceeds its cooldown or hourly or daily limit.
+	ErrRateLimited = errors.New("command rate limited")
+	// ErrInterlock is returned when the state of the device does not allow the command.
+	ErrInterlock = errors.New("command refused by safety interlock")
+)
+
+// SafetyError explains why the safety layer refused a command.
+type SafetyError struct {
+	Err        error
+	Device     string
+	Command    Command
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *SafetyError) Error() string {
+	return fmt.Sprintf("%s on %s: %s", e.Command, e.Device, e.Reason)
+}
+
+func (e *SafetyError) Unwrap() error {
+	return e.Err
+}
+
+// WaterLevelSource provides the most recent water level flag of a device.
+type WaterLevelSource interface {
+	LatestWaterLevel(ctx context.Context, device string) (bool, time.Time, error)
+}
+
+// SafetyLimits bounds how often and how much a command may run on a device, zero disables a limit.
+// The volume and run time budgets count the ml and durationMs of the commands, a command sent without
+// them counts DefaultMl and DefaultRun, the dose of the controller.
+type SafetyLimits struct {
+	Cooldown   time.Duration
+	MaxPerHour int
+	MaxPerDay  int
+
+	MaxMlPerHour  float64
+	MaxMlPerDay   float64
+	MaxRunPerHour time.Duration
+	MaxRunPerDay  time.Duration
+	DefaultMl     float64
+	DefaultRun    time.Duration
+}
+
+// dose returns the volume and run time counted for a command with p.
+func (l SafetyLimits) dose(p CommandParams) (float64, time.Duration) {
+	switch {
+	case p.Ml != nil:
+		return *p.Ml, 0
+	case p.DurationMs != nil:
+		return 0, time.Duration(*p.DurationMs) * time.Millisecond
+	}
+	return l.DefaultMl, l.DefaultRun
+}
+
+// SafetyConfig structure containing the limits of the dosing and light commands. Water and nutrient
+// dosing is refused while the water level flag reports the reservoir at its minimum, or when the flag
+// is missing or older than MaxWaterReadingAge.
+type SafetyConfig struct {
+	Dose               SafetyLimits
+	Light              SafetyLimits
+	MaxWaterReadingAge time.Duration
+}
+
+const defaultMaxWaterReadingAge = 10 * time.Minute
+
+// SafeClient is a HydroponicClient enforcing the safety limits and interlocks before the commands
+// reach the controller.
+type SafeClient struct {
+	next  HydroponicClient
+	water WaterLevelSource
+	cfg   SafetyConfig
+
+	mu      sync.Mutex
+	history map[string][]safetyEntry
+}
+
+// safetyEntry is a command counted against the limits.
+type safetyEntry struct {
+	at  time.Time
+	ml  float64
+	run time.Duration
+}
+
+// NewSafeClient returns the client guarding the commands sent through next.
+func NewSafeClient(cfg *SafetyConfig, next *MqttHydroponicClient, water WaterLevelSource) *SafeClient {
+	c := *cfg
+	if c.MaxWaterReadingAge <= 0 {
+		c.MaxWaterReadingAge = defaultMaxWaterReadingAge
+	}
+	log.Debug().Interface("safety config", c).Msg("safety interlocks enabled")
+	s := &SafeClient{next: next, water: water, cfg: c, history: make(map[string][]safetyEntry)}
+	// the limits are checked when a command is queued, the outbox must not deliver them back to back
+	next.setReplaySpacing(func(cmd Command) time.Duration { return s.limits(cmd).Cooldown })
+	return s
+}
+
+func (s *SafeClient) limits(cmd Command) SafetyLimits {
+	switch cmd {
+	case LightChangeCommand, LightOnCommand, LightOffCommand:
+		return s.cfg.Light
+	}
+	return s.cfg.Dose
+}
+
+// needsWater reports whether the command draws from the reservoir.
+func needsWater(cmd Command) bool {
+	return cmd == AddWaterCommand || cmd == SoilCommand
+}
+
+// check records the command when it is allowed and explains the refusal otherwise. The entry is
+// recorded right away so concurrent commands see it, send releases it if the command did not run.
+func (s *SafeClient) check(ctx context.Context, device string, cmd Command, p CommandParams, now time.Time) error {
+	refuse := func(err error, retry time.Duration, format string, args ...interface{}) error {
+		e := &SafetyError{Err: err, Device: device, Command: cmd, Reason: fmt.Sprintf(format, args...), RetryAfter: retry}
+		log.Warn().Str("device", device).Stringer("command", cmd).Str("reason", e.Reason).Msg("command refused")
+		return e
+	}
+
+	if needsWater(cmd) {
+		// without a recent reading the reservoir may be empty, the pump must not run dry
+		low, ts, err := s.water.LatestWaterLevel(ctx, device)
+		switch {
+		case err != nil:
+			return refuse(ErrInterlock, 0, "reservoir water level is unknown: %v", err)
+		case now.Sub(ts) > s.cfg.MaxWaterReadingAge:
+			return refuse(ErrInterlock, 0, "reservoir water level reading from %s is too old", ts.Format(time.RFC3339))
+		case low:
+			return refuse(ErrInterlock, 0, "reservoir water level is low since %s", ts.Format(time.RFC3339))
+		}
+	}
+
+	l := s.limits(cmd)
+	key := historyKey(device, cmd)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.history[key]
+	// forget what is older than the daily window
+	for len(h) > 0 && now.Sub(h[0].at) >= 24*time.Hour {
+		h = h[1:]
+	}
+	s.history[key] = h
+	var inHour []safetyEntry
+	for i, e := range h {
+		if now.Sub(e.at) < time.Hour {
+			inHour = h[i:]
+			break
+		}
+	}
+
+	if n := len(h); l.Cooldown > 0 && n > 0 && now.Sub(h[n-1].at) < l.Cooldown {
+		return refuse(ErrRateLimited, h[n-1].at.Add(l.Cooldown).Sub(now), "cooldown of %s not elapsed", l.Cooldown)
+	}
+	if l.MaxPerHour > 0 && len(inHour) >= l.MaxPerHour {
+		return refuse(ErrRateLimited, inHour[0].at.Add(time.Hour).Sub(now), "hourly limit of %d reached", l.MaxPerHour)
+	}
+	if l.MaxPerDay > 0 && len(h) >= l.MaxPerDay {
+		return refuse(ErrRateLimited, h[0].at.Add(24*time.Hour).Sub(now), "daily limit of %d reached", l.MaxPerDay)
+	}
+
+	ml, run := l.dose(p)
+	volume := func(e safetyEntry) float64 { return e.ml }
+	runTime := func(e safetyEntry) float64 { return float64(e.run) }
+	for _, b := range []struct {
+		entries []safetyEntry
+		window  time.Duration
+		used    func(safetyEntry) float64
+		want    float64
+		max     float64
+		reason  string
+	}{
+		{inHour, time.Hour, volume, ml, l.MaxMlPerHour, fmt.Sprintf("hourly budget of %gml", l.MaxMlPerHour)},
+		{h, 24 * time.Hour, volume, ml, l.MaxMlPerDay, fmt.Sprintf("daily budget of %gml", l.MaxMlPerDay)},
+		{inHour, time.Hour, runTime, float64(run), float64(l.MaxRunPerHour), fmt.Sprintf("hourly run time budget of %s", l.MaxRunPerHour)},
+		{h, 24 * time.Hour, runTime, float64(run), float64(l.MaxRunPerDay), fmt.Sprintf("daily run time budget of %s", l.MaxRunPerDay)},
+	} {
+		if b.max <= 0 {
+			continue
+		}
+		if retry, ok := budgetRetry(b.entries, b.used, b.want, b.max, b.window, now); !ok {
+			return refuse(ErrRateLimited, retry, "%s exceeded", b.reason)
+		}
+	}
+
+	s.history[key] = append(h, safetyEntry{at: now, ml: ml, run: run})
+	return nil
+}
+
+func historyKey(device string, cmd Command) string {
+	return device + "/" + cmd.String()
+}
+
+// release forgets the entry recorded by check at now.
+func (s *SafeClient) release(device string, cmd Command, now time.Time) {
+	key := historyKey(device, cmd)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.history[key]
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i].at.Equal(now) {
+			s.history[key] = append(h[:i:i], h[i+1:]...)
+			return
+		}
+	}
+}
+
+// budgetRetry reports whether want fits in the budget max with the entries of the window, oldest first.
+// Otherwise it returns how long until enough of the entries left the window, zero when want alone
+// exceeds the budget.
+func budgetRetry(entries []safetyEntry, used func(safetyEntry) float64, want, max float64, window time.Duration, now time.Time) (time.Duration, bool) {
+	var total float64
+	for _, e := range entries {
+		total += used(e)
+	}
+	if total+want <= max {
+		return 0, true
+	}
+	if want > max {
+		return 0, false
+	}
+	for _, e := range entries {
+		total -= used(e)
+		if total+want <= max {
+			return e.at.Add(window).Sub(now), false
+		}
+	}
+	return 0, false
+}
+
+func (s *SafeClient) send(ctx context.Context, device string, cmd Command, p CommandParams, fn func(context.Context, string) error) error {
+	now := time.Now()
+	if err := s.check(ctx, device, cmd, p, now); err != nil {
+		return err
+	}
+	err := fn(ctx, device)
+	if !commandMayHaveRun(err) {
+		s.release(device, cmd, now)
+	}
+	return err
+}
+
+func (s *SafeClient) SendUpPh(ctx context.Context, device string) error {
+	return s.send(ctx, device, PhUpCommand, CommandParams{}, s.next.SendUpPh)
+}
+
+func (s *SafeClient) SendDownPh(ctx context.Context, device string) error {
+	return s.send(ctx, device, PhDownCommand, CommandParams{}, s.next.SendDownPh)
+}
+
+func (s *SafeClient) SendAddSoil(ctx context.Context, device string) error {
+	return s.send(ctx, device, SoilCommand, CommandParams{}, s.next.SendAddSoil)
+}
+
+func (s *SafeClient) SendAddWater(ctx context.Context, device string) error {
+	return s.send(ctx, device, AddWaterCommand, CommandParams{}, s.next.SendAddWater)
+}
+
+func (s *SafeClient) SendChangeLight(ctx context.Context, device string) error {
+	return s.send(ctx, device, LightChangeCommand, CommandParams{}, s.next.SendChangeLight)
+}
+
+func (s *SafeClient) SetLight(ctx context.Context, device string, on bool) error {
+	cmd := LightOffCommand
+	if on {
+		cmd = LightOnCommand
+	}
+	return s.send(ctx, device, cmd, CommandParams{}, func(ctx context.Context, device string) error {
+		return s.next.SetLight(ctx, device, on)
+	})
+}
+
+func (s *SafeClient) Send(ctx context.Context, device string, cmd Command, p CommandParams) error {
+	// invalid parameters must not count against the limits
+	if err := p.check(cmd); err != nil {
+		return err
+	}
+	return s.send(ctx, device, cmd, p, func(ctx context.Context, device string) error {
+		return s.next.Send(ctx, device, cmd, p)
+	})
+}
+
+// Drain implements Drainer.
+func (s *SafeClient) Drain(ctx context.Context) error {
+	if d, ok := s.next.(Drainer); ok {
+		return d.Drain(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+)
+
+// fakeWater serves a fixed water level flag.
+type fakeWater struct {
+	low bool
+	ts  time.Time
+	err error
+}
+
+func (f *fakeWater) LatestWaterLevel(context.Context, string) (bool, time.Time, error) {
+	return f.low, f.ts, f.err
+}
+
+func newTestSafeClient(water *fakeWater) (*SafeClient, *fakeClient) {
+	cli := &fakeClient{}
+	s := &SafeClient{
+		next:  cli,
+		water: water,
+		cfg: SafetyConfig{
+			Dose:               SafetyLimits{Cooldown: time.Minute, MaxPerHour: 3, MaxPerDay: 5},
+			Light:              SafetyLimits{Cooldown: 10 * time.Second},
+			MaxWaterReadingAge: 10 * time.Minute,
+		},
+		history: make(map[string][]safetyEntry),
+	}
+	return s, cli
+}
+
+// refusal returns the SafetyError of err, failing the test when the command was not refused by it.
+func refusal(t *testing.T, err error, kind error) *SafetyError {
+	t.Helper()
+	var se *SafetyError
+	if !errors.As(err, &se) || !errors.Is(err, kind) {
+		t.Fatalf("got %v, want a %v refusal", err, kind)
+	}
+	return se
+}
+
+func TestSafeClientRateLimits(t *testing.T) {
+	s, _ := newTestSafeClient(&fakeWater{})
+	ctx := context.Background()
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := s.check(ctx, "tank-1", PhUpCommand, CommandParams{}, now); err != nil {
+		t.Fatalf("first dose refused: %v", err)
+	}
+	se := refusal(t, s.check(ctx, "tank-1", PhUpCommand, CommandParams{}, now.Add(20*time.Second)), ErrRateLimited)
+	if se.RetryAfter != 40*time.Second {
+		t.Errorf("retry after %s during the cooldown, want 40s", se.RetryAfter)
+	}
+	// the limits are per device and command
+	if err := s.check(ctx, "tank-1", PhDownCommand, CommandParams{}, now.Add(20*time.Second)); err != nil {
+		t.Errorf("other command refused: %v", err)
+	}
+	if err := s.check(ctx, "tank-2", PhUpCommand, CommandParams{}, now.Add(20*time.Second)); err != nil {
+		t.Errorf("other device refused: %v", err)
+	}
+
+	for _, m := range []time.Duration{time.Minute, 2 * time.Minute} {
+		if err := s.check(ctx, "tank-1", PhUpCommand, CommandParams{}, now.Add(m)); err != nil {
+			t.Fatalf("dose at +%s refused: %v", m, err)
+		}
+	}
+	se = refusal(t, s.check(ctx, "tank-1", PhUpCommand, CommandParams{}, now.Add(10*time.Minute)), ErrRateLimited)
+	if se.RetryAfter != 50*time.Minute {
+		t.Errorf("retry after %s at the hourly limit, want 50m", se.RetryAfter)
+	}
+
+	// the first dose leaves the hourly window, two more fit in the day
+	for _, m := range []time.Duration{time.Hour, 2 * time.Hour} {
+		if err := s.check(ctx, "tank-1", PhUpCommand, CommandParams{}, now.Add(m)); err != nil {
+			t.Fatalf("dose at +%s refused: %v", m, err)
+		}
+	}
+	se = refusal(t, s.check(ctx, "tank-1", PhUpCommand, CommandParams{}, now.Add(3*time.Hour)), ErrRateLimited)
+	if se.RetryAfter != 21*time.Hour {
+		t.Errorf("retry after %s at the daily limit, want 21h", se.RetryAfter)
+	}
+	if err := s.check(ctx, "tank-1", PhUpCommand, CommandParams{}, now.Add(24*time.Hour)); err != nil {
+		t.Errorf("dose refused once the first one left the daily window: %v", err)
+	}
+}
+
+func TestSafeClientLightLimits(t *testing.T) {
+	s, cli := newTestSafeClient(&fakeWater{})
+	ctx := context.Background()
+
+	if err := s.SetLight(ctx, "tank-1", true); err != nil {
+		t.Fatalf("light refused: %v", err)
+	}
+	refusal(t, s.SetLight(ctx, "tank-1", true), ErrRateLimited)
+	// the light has no hourly or daily limit and does not share the dose history
+	now := time.Now()
+	for i := 1; i <= 5; i++ {
+		if err := s.check(ctx, "tank-1", LightOffCommand, CommandParams{}, now.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatalf("light %d refused: %v", i, err)
+		}
+	}
+	if err := s.SendUpPh(ctx, "tank-1"); err != nil {
+		t.Errorf("dose refused after light commands: %v", err)
+	}
+	if cli.count() != 2 {
+		t.Errorf("%d commands forwarded, want 2", cli.count())
+	}
+
+	// invalid parameters are not counted
+	if err := s.Send(ctx, "tank-2", PhUpCommand, CommandParams{Intensity: new(uint8)}); err == nil {
+		t.Fatal("invalid parameters accepted")
+	}
+	if err := s.SendUpPh(ctx, "tank-2"); err != nil {
+		t.Errorf("dose refused after invalid parameters: %v", err)
+	}
+}
+
+func TestSafeClientFailedCommands(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		err     error
+		counted bool
+	}{
+		{ErrClientClosing, false},
+		{ErrUnknownDevice, false},
+		{ErrPublishTimeout, false},
+		{&CommandError{Command: PhUpCommand, Err: "pump busy"}, false},
+		{ErrAckTimeout, true},
+		{ErrCommandQueued, true},
+	} {
+		s, cli := newTestSafeClient(&fakeWater{})
+		cli.err = tc.err
+		if err := s.SendUpPh(ctx, "tank-1"); !errors.Is(err, tc.err) {
+			t.Errorf("%v: got %v", tc.err, err)
+		}
+		cli.err = nil
+		err := s.SendUpPh(ctx, "tank-1")
+		if tc.counted {
+			refusal(t, err, ErrRateLimited)
+		} else if err != nil {
+			t.Errorf("%v: next dose refused: %v", tc.err, err)
+		}
+	}
+}
+
+func TestSafeClientBudgets(t *testing.T) {
+	s, _ := newTestSafeClient(&fakeWater{})
+	s.cfg.Dose = SafetyLimits{MaxMlPerHour: 50, MaxMlPerDay: 80, MaxRunPerHour: time.Minute, DefaultMl: 10}
+	ctx := context.Background()
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	ml := func(v float64) CommandParams { return CommandParams{Ml: &v} }
+	run := func(ms uint32) CommandParams { return CommandParams{DurationMs: &ms} }
+
+	if err := s.check(ctx, "tank-1", PhUpCommand, ml(30), now); err != nil {
+		t.Fatalf("first dose refused: %v", err)
+	}
+	// the default dose counts 10ml
+	if err := s.check(ctx, "tank-1", PhUpCommand, CommandParams{}, now.Add(10*time.Minute)); err != nil {
+		t.Fatalf("default dose refused: %v", err)
+	}
+	se := refusal(t, s.check(ctx, "tank-1", PhUpCommand, ml(20), now.Add(20*time.Minute)), ErrRateLimited)
+	if se.RetryAfter != 40*time.Minute {
+		t.Errorf("retry after %s over the hourly volume, want 40m", se.RetryAfter)
+	}
+	if err := s.check(ctx, "tank-1", PhUpCommand, ml(10), now.Add(20*time.Minute)); err != nil {
+		t.Errorf("dose within the hourly volume refused: %v", err)
+	}
+	se = refusal(t, s.check(ctx, "tank-1", PhUpCommand, ml(60), now.Add(2*time.Hour)), ErrRateLimited)
+	if se.RetryAfter != 0 {
+		t.Errorf("retry after %s for a dose over the budget, want none", se.RetryAfter)
+	}
+	// 50ml of the 80ml daily volume are used
+	se = refusal(t, s.check(ctx, "tank-1", PhUpCommand, ml(40), now.Add(2*time.Hour)), ErrRateLimited)
+	if se.RetryAfter != 22*time.Hour {
+		t.Errorf("retry after %s over the daily volume, want 22h", se.RetryAfter)
+	}
+
+	// the run time budget counts durationMs
+	if err := s.check(ctx, "tank-1", PhDownCommand, run(45000), now); err != nil {
+		t.Fatalf("first run refused: %v", err)
+	}
+	se = refusal(t, s.check(ctx, "tank-1", PhDownCommand, run(20000), now.Add(time.Minute)), ErrRateLimited)
+	if se.RetryAfter != 59*time.Minute {
+		t.Errorf("retry after %s over the hourly run time, want 59m", se.RetryAfter)
+	}
+	if err := s.check(ctx, "tank-1", PhDownCommand, run(15000), now.Add(time.Minute)); err != nil {
+		t.Errorf("run within the budget refused: %v", err)
+	}
+}
+
+func TestSafeClientWaterInterlock(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		water   fakeWater
+		refused bool
+	}{
+		{"level ok", fakeWater{ts: now.Add(-time.Minute)}, false},
+		{"level low", fakeWater{low: true, ts: now.Add(-time.Minute)}, true},
+		{"no reading", fakeWater{err: ErrNoReading}, true},
+		{"stale reading", fakeWater{ts: now.Add(-11 * time.Minute)}, true},
+	} {
+		s, _ := newTestSafeClient(&tc.water)
+		for _, cmd := range []Command{AddWaterCommand, SoilCommand} {
+			err := s.check(ctx, "tank-1", cmd, CommandParams{}, now)
+			if !tc.refused {
+				if err != nil {
+					t.Errorf("%s: %s refused: %v", tc.name, cmd, err)
+				}
+				continue
+			}
+			if !errors.Is(err, ErrInterlock) {
+				t.Errorf("%s: %s got %v, want an interlock", tc.name, cmd, err)
+			}
+		}
+		// the interlock only applies to the commands drawing from the reservoir
+		if err := s.check(ctx, "tank-1", PhUpCommand, CommandParams{}, now); err != nil {
+			t.Errorf("%s: ph_up refused: %v", tc.name, err)
+		}
+	}
+}
+
+func TestCommandResultSafety(t *testing.T) {
+	e := echo.New()
+	for _, tc := range []struct {
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{&SafetyError{Err: ErrRateLimited, Reason: "cooldown", RetryAfter: 1500 * time.Millisecond}, http.StatusTooManyRequests, "2"},
+		{&SafetyError{Err: ErrRateLimited, Reason: "limit"}, http.StatusTooManyRequests, ""},
+		{&SafetyError{Err: ErrInterlock, Reason: "water low"}, http.StatusConflict, ""},
+	} {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec)
+		err := commandResult(c, tc.err, "test")
+		he, ok := err.(*echo.HTTPError)
+		if !ok || he.Code != tc.status {
+			t.Errorf("%v: got %v, want status %d", tc.err, err, tc.status)
+			continue
+		}
+		if got := rec.Header().Get("Retry-After"); got != tc.retryAfter {
+			t.Errorf("%v: Retry-After %q, want %q", tc.err, got, tc.retryAfter)
+		}
+	}
+}
@@ -1,11 +1,156 @@
 package internal
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
 
+// SensorData is a snapshot of the sensors at Timestamp, readings missing from the snapshot are nil.
+// MinWaterLevel is set when the reservoir dropped to its minimum level.
 type SensorData struct {
-	Light         float64   `json:"light"`
-	SoilMoisture  float64   `json:"soilMoisture"`
-	PH            float64   `json:"pH"`
-	MinWaterLevel bool      `json:"minWaterLevel"`
+	Device        string    `json:"device,omitempty"`
+	Light         *float64  `json:"light" validate:"omitempty,min=0"`
+	SoilMoisture  *float64  `json:"soilMoisture" validate:"omitempty,min=0,max=100"`
+	PH            *float64  `json:"pH" validate:"omitempty,min=0,max=14"`
+	MinWaterLevel *bool     `json:"minWaterLevel"`
 	Timestamp     time.Time `json:"ts"`
 }
+
+// Empty reports whether the snapshot has no readings at all.
+func (s SensorData) Empty() bool {
+	return s.Light == nil && s.SoilMoisture == nil && s.PH == nil && s.MinWaterLevel == nil
+}
+
+// value returns the reading of f as a number, the water level flag is 1 when set.
+func (s SensorData) value(f SensorField) (float64, bool) {
+	switch f {
+	case FieldPH:
+		if s.PH != nil {
+			return *s.PH, true
+		}
+	case FieldLight:
+		if s.Light != nil {
+			return *s.Light, true
+		}
+	case FieldSoilMoisture:
+		if s.SoilMoisture != nil {
+			return *s.SoilMoisture, true
+		}
+	case FieldMinWaterLevel:
+		if s.MinWaterLevel != nil {
+			if *s.MinWaterLevel {
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// SensorField is the name of a reading in the sensors measurement.
+type SensorField string
+
+const (
+	FieldPH            SensorField = "ph"
+	FieldLight         SensorField = "light"
+	FieldSoilMoisture  SensorField = "soil"
+	FieldMinWaterLevel SensorField = "lvl"
+)
+
+var sensorFieldNames = map[string]SensorField{
+	"ph":            FieldPH,
+	"light":         FieldLight,
+	"soilmoisture":  FieldSoilMoisture,
+	"soil":          FieldSoilMoisture,
+	"minwaterlevel": FieldMinWaterLevel,
+	"lvl":           FieldMinWaterLevel,
+}
+
+// ParseSensorField accepts the json name of a SensorData reading or its stored name, case-insensitively.
+func ParseSensorField(name string) (SensorField, error) {
+	f, ok := sensorFieldNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return "", fmt.Errorf("unknown sensor field %q", name)
+	}
+	return f, nil
+}
+
+// SeriesPoint is a single value of a sensor series, encoded as [ts, value].
+type SeriesPoint struct {
+	Timestamp time.Time
+	Value     interface{}
+}
+
+func (p SeriesPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{p.Timestamp, p.Value})
+}
+
+// Reading is the latest value of a sensor field.
+type Reading[T float64 | bool] struct {
+	Value     T         `json:"value"`
+	Timestamp time.Time `json:"ts"`
+}
+
+// LatestReadings holds the most recent value of every field, fields never reported are nil.
+type LatestReadings struct {
+	Light         *Reading[float64] `json:"light"`
+	SoilMoisture  *Reading[float64] `json:"soilMoisture"`
+	PH            *Reading[float64] `json:"pH"`
+	MinWaterLevel *Reading[bool]    `json:"minWaterLevel"`
+}
+
+// set stores v as the value of f unless a newer value is already known.
+func (l *LatestReadings) set(f SensorField, v interface{}, ts time.Time) {
+	switch f {
+	case FieldPH:
+		setReading(&l.PH, v, ts)
+	case FieldLight:
+		setReading(&l.Light, v, ts)
+	case FieldSoilMoisture:
+		setReading(&l.SoilMoisture, v, ts)
+	case FieldMinWaterLevel:
+		setReading(&l.MinWaterLevel, v, ts)
+	}
+}
+
+// merge applies the readings present in the snapshot.
+func (l *LatestReadings) merge(d SensorData) {
+	if d.PH != nil {
+		l.set(FieldPH, *d.PH, d.Timestamp)
+	}
+	if d.Light != nil {
+		l.set(FieldLight, *d.Light, d.Timestamp)
+	}
+	if d.SoilMoisture != nil {
+		l.set(FieldSoilMoisture, *d.SoilMoisture, d.Timestamp)
+	}
+	if d.MinWaterLevel != nil {
+		l.set(FieldMinWaterLevel, *d.MinWaterLevel, d.Timestamp)
+	}
+}
+
+// mergeLatest applies the readings of o that are newer than the known ones.
+func (l *LatestReadings) mergeLatest(o LatestReadings) {
+	if o.PH != nil {
+		setReading(&l.PH, o.PH.Value, o.PH.Timestamp)
+	}
+	if o.Light != nil {
+		setReading(&l.Light, o.Light.Value, o.Light.Timestamp)
+	}
+	if o.SoilMoisture != nil {
+		setReading(&l.SoilMoisture, o.SoilMoisture.Value, o.SoilMoisture.Timestamp)
+	}
+	if o.MinWaterLevel != nil {
+		setReading(&l.MinWaterLevel, o.MinWaterLevel.Value, o.MinWaterLevel.Timestamp)
+	}
+}
+
+func setReading[T float64 | bool](r **Reading[T], v interface{}, ts time.Time) {
+	val, ok := v.(T)
+	if !ok || (*r != nil && !ts.After((*r).Timestamp)) {
+		return
+	}
+	*r = &Reading[T]{Value: val, Timestamp: ts}
+}
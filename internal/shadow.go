@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// LightStateSource provides the light state last reported by a device.
+type LightStateSource interface {
+	LightState(device string) LightState
+}
+
+// Actuators tracked by the device shadow, the pumps are named after their command.
+const (
+	ActuatorLight = "light"
+)
+
+// commandActuator returns the actuator driven by cmd.
+func commandActuator(cmd Command) string {
+	switch cmd {
+	case LightChangeCommand, LightOnCommand, LightOffCommand:
+		return ActuatorLight
+	default:
+		return cmd.String()
+	}
+}
+
+// ShadowValue is a state of an actuator. The light has a switch state, a pump is
+// described by the last dose, identified by its command.
+type ShadowValue struct {
+	On        *bool          `json:"on,omitempty"`
+	CommandID string         `json:"commandId,omitempty"`
+	Params    *CommandParams `json:"params,omitempty"`
+	Timestamp time.Time      `json:"ts"`
+}
+
+// ActuatorShadow holds what was asked of an actuator and what the device reported.
+// Drift is set while the reported state does not match the desired one.
+type ActuatorShadow struct {
+	Desired  *ShadowValue `json:"desired"`
+	Reported *ShadowValue `json:"reported"`
+	Drift    bool         `json:"drift"`
+}
+
+func (a ActuatorShadow) drift() bool {
+	switch {
+	case a.Desired == nil:
+		return false
+	case a.Reported == nil:
+		return true
+	case a.Desired.On != nil:
+		return a.Reported.On == nil || *a.Reported.On != *a.Desired.On
+	default:
+		return a.Reported.CommandID != a.Desired.CommandID
+	}
+}
+
+// DeviceShadow is the state of the actuators of a device.
+type DeviceShadow struct {
+	Device    string                     `json:"device"`
+	Actuators map[string]*ActuatorShadow `json:"actuators"`
+	Drift     bool                       `json:"drift"`
+}
+
+// ShadowConfig structure containing the file the shadow is persisted to. The changes are written
+// at most once per SaveDelay, off the mqtt callbacks.
+type ShadowConfig struct {
+	File      string
+	SaveDelay time.Duration
+}
+
+func (sc *ShadowConfig) checkConfig() error {
+	log.Debug().Msg("checking shadow config")
+
+	if sc.File == "" {
+		return errors.New("shadow file is not configured")
+	}
+	if sc.SaveDelay <= 0 {
+		sc.SaveDelay = time.Second
+	}
+	return nil
+}
+
+// Shadow keeps the desired and reported state of the actuators of every device.
+// The desired state follows the commands sent, the reported one the light states and
+// the acknowledged doses. It is rewritten to the file shortly after every change.
+type Shadow struct {
+	path      string
+	reg       *DeviceRegistry
+	saveDelay time.Duration
+	dirty     chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+
+	mu      sync.Mutex
+	devices map[string]map[string]*ActuatorShadow
+	closed  bool
+}
+
+// NewShadow loads the persisted shadow and follows the telemetry of the source.
+// The returned function writes the pending changes.
+func NewShadow(cfg *ShadowConfig, reg *DeviceRegistry, src TelemetrySource) (*Shadow, func(), error) {
+	c := *cfg
+	if err := c.checkConfig(); err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.File), 0o755); err != nil {
+		return nil, nil, errors.Wrap(err, "can not create shadow directory")
+	}
+	s := &Shadow{
+		path:      c.File,
+		reg:       reg,
+		saveDelay: c.SaveDelay,
+		dirty:     make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		devices:   make(map[string]map[string]*ActuatorShadow),
+	}
+	b, err := os.ReadFile(c.File)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, nil, errors.Wrap(err, "can not read shadow")
+	case len(b) > 0:
+		if err := json.Unmarshal(b, &s.devices); err != nil {
+			return nil, nil, errors.Wrap(err, "can not decode shadow")
+		}
+	}
+
+	go s.persist()
+	src.OnCommandResult(func(r CommandResult) {
+		s.commanded(r)
+	})
+	src.OnLightState(func(ls LightState) {
+		s.reportLight(ls, time.Now())
+	})
+	return s, s.Close, nil
+}
+
+func (s *Shadow) actuator(device, name string) *ActuatorShadow {
+	d, ok := s.devices[device]
+	if !ok {
+		d = make(map[string]*ActuatorShadow)
+		s.devices[device] = d
+	}
+	a, ok := d[name]
+	if !ok {
+		a = &ActuatorShadow{}
+		d[name] = a
+	}
+	return a
+}
+
+// commanded sets the desired state from a command, the acknowledgement of a dose is its reported state.
+// Only acknowledged and queued commands are desired, a queued command that fails later is forgotten.
+func (s *Shadow) commanded(r CommandResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.actuator(r.Device, commandActuator(r.Command))
+	if r.Outcome != OutcomeAcknowledged && r.Outcome != OutcomeQueued {
+		if a.Desired != nil && a.Desired.CommandID == r.ID {
+			a.Desired = nil
+			s.save()
+		}
+		return
+	}
+	// a replayed command is reported again, a toggle must not flip the light twice
+	if a.Desired == nil || a.Desired.CommandID != r.ID {
+		v := &ShadowValue{CommandID: r.ID, Params: r.Params, Timestamp: r.Timestamp}
+		switch r.Command {
+		case LightOnCommand, LightOffCommand:
+			on := r.Command == LightOnCommand
+			v.On = &on
+		case LightChangeCommand:
+			on := true
+			if cur := current(a); cur != nil && cur.On != nil {
+				on = !*cur.On
+			}
+			v.On = &on
+		}
+		a.Desired = v
+	}
+	if r.Outcome == OutcomeAcknowledged && a.Desired.On == nil {
+		a.Reported = &ShadowValue{CommandID: r.ID, Params: r.Params, Timestamp: r.Timestamp}
+	}
+	s.save()
+}
+
+// current returns the reported state, the desired one until the device reports.
+func current(a *ActuatorShadow) *ShadowValue {
+	if a.Reported != nil {
+		return a.Reported
+	}
+	return a.Desired
+}
+
+func (s *Shadow) reportLight(ls LightState, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	on := ls.IsUp
+	s.actuator(ls.Device, ActuatorLight).Reported = &ShadowValue{On: &on, Timestamp: now}
+	s.save()
+}
+
+// save schedules the shadow to be persisted, it is called with the lock held.
+// Once closed the results of the commands drained on shutdown are written right away.
+func (s *Shadow) save() {
+	if s.closed {
+		s.writeLocked()
+		return
+	}
+	select {
+	case s.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// persist writes the changes, waiting SaveDelay after the first one so a burst is written once.
+func (s *Shadow) persist() {
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.dirty:
+		case <-s.stop:
+			return
+		}
+		select {
+		case <-time.After(s.saveDelay):
+		case <-s.stop:
+		}
+		s.write()
+	}
+}
+
+// write persists the shadow, the file is written without holding the lock.
+func (s *Shadow) write() {
+	s.mu.Lock()
+	b, err := json.Marshal(s.devices)
+	s.mu.Unlock()
+	s.writeFile(b, err)
+}
+
+func (s *Shadow) writeLocked() {
+	b, err := json.Marshal(s.devices)
+	s.writeFile(b, err)
+}
+
+// writeFile replaces the shadow file, a failure is only logged as the state in memory stays valid.
+func (s *Shadow) writeFile(b []byte, err error) {
+	if err == nil {
+		err = writeFileAtomic(s.path, b)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("can not persist device shadow")
+	}
+}
+
+// Close stops persisting and writes the pending changes.
+func (s *Shadow) Close() {
+	close(s.stop)
+	<-s.stopped
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	select {
+	case <-s.dirty:
+		s.writeLocked()
+	default:
+	}
+}
+
+// LightState returns the light state last reported by the device, off until it reports.
+func (s *Shadow) LightState(device string) LightState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ls := LightState{Device: device}
+	if a, ok := s.devices[device][ActuatorLight]; ok && a.Reported != nil && a.Reported.On != nil {
+		ls.IsUp = *a.Reported.On
+	}
+	return ls
+}
+
+// Device returns a copy of the shadow of the device.
+func (s *Shadow) Device(device string) DeviceShadow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ds := DeviceShadow{Device: device, Actuators: make(map[string]*ActuatorShadow)}
+	for name, a := range s.devices[device] {
+		c := *a
+		c.Drift = c.drift()
+		ds.Actuators[name] = &c
+		ds.Drift = ds.Drift || c.Drift
+	}
+	return ds
+}
+
+// Devices returns the shadow of every registered device, ordered by id.
+func (s *Shadow) Devices() []DeviceShadow {
+	ids := s.reg.IDs()
+	res := make([]DeviceShadow, 0, len(ids))
+	for _, id := range ids {
+		res = append(res, s.Device(id))
+	}
+	return res
+}
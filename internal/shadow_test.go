@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestShadow(t *testing.T, file string) (*Shadow, func()) {
+	t.Helper()
+	reg, err := NewDeviceRegistry(&DeviceConfig{Devices: []string{"tank-1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s, closeShadow, err := NewShadow(&ShadowConfig{File: file, SaveDelay: time.Millisecond}, reg, &fakeTelemetry{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s, closeShadow
+}
+
+func TestActuatorShadowDrift(t *testing.T) {
+	on, off := true, false
+	for _, tc := range []struct {
+		name  string
+		a     ActuatorShadow
+		drift bool
+	}{
+		{"nothing desired", ActuatorShadow{Reported: &ShadowValue{On: &on}}, false},
+		{"not reported yet", ActuatorShadow{Desired: &ShadowValue{On: &on}}, true},
+		{"light matches", ActuatorShadow{Desired: &ShadowValue{On: &on}, Reported: &ShadowValue{On: &on}}, false},
+		{"light differs", ActuatorShadow{Desired: &ShadowValue{On: &on}, Reported: &ShadowValue{On: &off}}, true},
+		{"dose acknowledged", ActuatorShadow{Desired: &ShadowValue{CommandID: "a"}, Reported: &ShadowValue{CommandID: "a"}}, false},
+		{"dose pending", ActuatorShadow{Desired: &ShadowValue{CommandID: "b"}, Reported: &ShadowValue{CommandID: "a"}}, true},
+	} {
+		if got := tc.a.drift(); got != tc.drift {
+			t.Errorf("%s: drift %v, want %v", tc.name, got, tc.drift)
+		}
+	}
+}
+
+func TestShadowToggle(t *testing.T) {
+	s, closeShadow := newTestShadow(t, filepath.Join(t.TempDir(), "shadow.json"))
+	defer closeShadow()
+	now := time.Now()
+	desired := func() *bool {
+		t.Helper()
+		a := s.Device("tank-1").Actuators[ActuatorLight]
+		if a == nil || a.Desired == nil {
+			return nil
+		}
+		return a.Desired.On
+	}
+
+	// a toggle before any report switches the light on
+	s.commanded(CommandResult{ID: "a", Device: "tank-1", Command: LightChangeCommand, Outcome: OutcomeAcknowledged, Timestamp: now})
+	if on := desired(); on == nil || !*on {
+		t.Fatalf("toggle without report desired %v", on)
+	}
+	s.reportLight(LightState{Device: "tank-1", IsUp: true}, now)
+	if s.Device("tank-1").Drift {
+		t.Error("drift once the light reported its state")
+	}
+
+	// the queued toggle is reported again by the replay, it flips the light once
+	s.commanded(CommandResult{ID: "b", Device: "tank-1", Command: LightChangeCommand, Outcome: OutcomeQueued, Timestamp: now})
+	s.commanded(CommandResult{ID: "b", Device: "tank-1", Command: LightChangeCommand, Outcome: OutcomeAcknowledged, Timestamp: now})
+	if on := desired(); on == nil || *on {
+		t.Fatalf("replayed toggle desired %v, want off", on)
+	}
+	if !s.Device("tank-1").Drift {
+		t.Error("no drift before the light reported")
+	}
+	s.reportLight(LightState{Device: "tank-1", IsUp: false}, now)
+	if s.Device("tank-1").Drift || s.LightState("tank-1").IsUp {
+		t.Errorf("shadow %+v after the report", s.Device("tank-1"))
+	}
+}
+
+func TestShadowFailedCommands(t *testing.T) {
+	s, closeShadow := newTestShadow(t, filepath.Join(t.TempDir(), "shadow.json"))
+	defer closeShadow()
+	now := time.Now()
+	pump := func() *ActuatorShadow {
+		return s.Device("tank-1").Actuators[PhUpCommand.String()]
+	}
+
+	s.commanded(CommandResult{ID: "a", Device: "tank-1", Command: PhUpCommand, Outcome: OutcomeAcknowledged, Timestamp: now})
+	if a := pump(); a.Drift || a.Reported == nil || a.Reported.CommandID != "a" {
+		t.Fatalf("acknowledged dose gave %+v", a)
+	}
+	for _, outcome := range []CommandOutcome{OutcomeRejected, OutcomeAckTimeout, OutcomePublishTimeout, OutcomeFailed, OutcomeExpired} {
+		s.commanded(CommandResult{ID: string(outcome), Device: "tank-1", Command: PhUpCommand, Outcome: outcome, Timestamp: now})
+		if a := pump(); a.Drift || a.Desired.CommandID != "a" {
+			t.Errorf("%s dose changed the desired state to %+v", outcome, a.Desired)
+		}
+	}
+
+	// a queued dose is desired until its replay fails
+	s.commanded(CommandResult{ID: "q", Device: "tank-1", Command: PhUpCommand, Outcome: OutcomeQueued, Timestamp: now})
+	if a := pump(); !a.Drift {
+		t.Error("no drift for the queued dose")
+	}
+	s.commanded(CommandResult{ID: "q", Device: "tank-1", Command: PhUpCommand, Outcome: OutcomeExpired, Timestamp: now})
+	if a := pump(); a.Drift || a.Desired != nil {
+		t.Errorf("expired dose left %+v", a)
+	}
+}
+
+func TestShadowReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "shadow", "shadow.json")
+	s, closeShadow := newTestShadow(t, file)
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.commanded(CommandResult{ID: "a", Device: "tank-1", Command: LightOnCommand, Outcome: OutcomeAcknowledged, Timestamp: now})
+	s.commanded(CommandResult{ID: "b", Device: "tank-1", Command: SoilCommand, Outcome: OutcomeAcknowledged, Timestamp: now})
+	s.reportLight(LightState{Device: "tank-1", IsUp: true}, now)
+	closeShadow()
+	// changes after the close are written right away
+	s.commanded(CommandResult{ID: "c", Device: "tank-1", Command: AddWaterCommand, Outcome: OutcomeQueued, Timestamp: now})
+
+	reloaded, closeReloaded := newTestShadow(t, file)
+	defer closeReloaded()
+	d := reloaded.Device("tank-1")
+	if !reloaded.LightState("tank-1").IsUp {
+		t.Error("reloaded light is off")
+	}
+	if a := d.Actuators[SoilCommand.String()]; a == nil || a.Drift || a.Reported.CommandID != "b" {
+		t.Errorf("reloaded soil pump %+v", a)
+	}
+	if a := d.Actuators[AddWaterCommand.String()]; a == nil || !a.Drift || a.Desired.CommandID != "c" {
+		t.Errorf("reloaded water pump %+v", a)
+	}
+}
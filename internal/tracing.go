@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is resolved through the global provider, spans are dropped until InitTracing configures an exporter.
+var tracer = otel.Tracer("github.com/kara/hydro/internal")
+
+// TracingConfig structure containing the OTLP/HTTP collector the traces are exported to.
+type TracingConfig struct {
+	Endpoint    string
+	Insecure    bool
+	ServiceName string
+	SampleRatio float64
+}
+
+func (tc *TracingConfig) checkConfig() error {
+	log.Debug().Msg("checking tracing config")
+
+	if tc.ServiceName == "" {
+		tc.ServiceName = "hydro"
+	}
+	if tc.SampleRatio < 0 || tc.SampleRatio > 1 {
+		return fmt.Errorf("trace sample ratio %.2f is out of range", tc.SampleRatio)
+	}
+	return nil
+}
+
+// InitTracing installs the global tracer provider exporting to the collector, it does nothing without an endpoint.
+// The returned function flushes the pending spans.
+func InitTracing(ctx context.Context, cfg *TracingConfig) (func(), error) {
+	c := *cfg
+	if err := c.checkConfig(); err != nil {
+		return nil, err
+	}
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if c.Endpoint == "" {
+		log.Info().Msg("tracing is not configured")
+		return func() {}, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.Endpoint)}
+	if c.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exp, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not create trace exporter")
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(c.ServiceName)))
+	if err != nil {
+		return nil, errors.Wrap(err, "can not create trace resource")
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	log.Info().Str("endpoint", c.Endpoint).Float64("sample ratio", c.SampleRatio).Msg("tracing initialized")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			log.Err(err).Msg("can not flush traces")
+		}
+	}, nil
+}
+
+// traceMiddleware starts a server span for every request, continuing the trace of the caller.
+func traceMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, req.Method+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(req.Method),
+				semconv.HTTPRoute(c.Path()),
+				semconv.HTTPTarget(req.URL.RequestURI()),
+				attribute.String("http.request_id", c.Response().Header().Get(echo.HeaderXRequestID)),
+			))
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+
+		status := c.Response().Status
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		}
+		span.SetAttributes(semconv.HTTPStatusCode(status))
+		if name := principal(c).Name; name != "" {
+			span.SetAttributes(attribute.String("enduser.id", name))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		return err
+	}
+}
+
+// spanError marks the span as failed and returns err.
+func spanError(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a recording provider, once per test binary as the package tracer keeps the first one.
+func recordSpans() *tracetest.SpanRecorder {
+	spansOnce.Do(func() {
+		spans = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return spans
+}
+
+// endedSpans returns the ended spans of the trace.
+func endedSpans(traceID trace.TraceID) []sdktrace.ReadOnlySpan {
+	var res []sdktrace.ReadOnlySpan
+	for _, s := range recordSpans().Ended() {
+		if s.SpanContext().TraceID() == traceID {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func spanAttribute(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceMiddleware(t *testing.T) {
+	recordSpans()
+	e := echo.New()
+	e.Use(traceMiddleware)
+	e.GET("/api/data/:device", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	e.GET("/api/fail", func(c echo.Context) error { return echo.NewHTTPError(http.StatusBadGateway) })
+
+	parent, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	parentSpan, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+	for _, tc := range []struct {
+		path   string
+		status int
+		failed bool
+	}{
+		{"/api/data/tank-1", http.StatusOK, false},
+		{"/api/fail", http.StatusBadGateway, true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		var found sdktrace.ReadOnlySpan
+		for _, s := range endedSpans(parent) {
+			if s.Parent().SpanID() == parentSpan && spanAttribute(s, "http.target").AsString() == tc.path {
+				found = s
+			}
+		}
+		if found == nil {
+			t.Fatalf("%s: no server span continuing the incoming trace", tc.path)
+		}
+		if found.SpanKind() != trace.SpanKindServer || !found.Parent().IsRemote() {
+			t.Errorf("%s: span kind %s, remote parent %v", tc.path, found.SpanKind(), found.Parent().IsRemote())
+		}
+		if got := spanAttribute(found, "http.status_code").AsInt64(); got != int64(tc.status) {
+			t.Errorf("%s: status attribute %d, want %d", tc.path, got, tc.status)
+		}
+		if (found.Status().Code == codes.Error) != tc.failed {
+			t.Errorf("%s: span status %v", tc.path, found.Status())
+		}
+	}
+}
+
+func TestSendCommandTracing(t *testing.T) {
+	recordSpans()
+	o, err := NewOutbox(&OutboxConfig{File: filepath.Join(t.TempDir(), "outbox.json")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reg, err := NewDeviceRegistry(&DeviceConfig{Devices: []string{"tank-1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b := &fakeBroker{open: true}
+	m := &MqttHydroponicClient{cli: b, reg: reg, outbox: o, ackTimeout: time.Second, pending: make(map[string]chan CommandAck)}
+	b.m = m
+
+	for _, tc := range []struct {
+		ackErr  string
+		open    bool
+		outcome CommandOutcome
+		failed  bool
+	}{
+		{"", true, OutcomeAcknowledged, false},
+		{"pump jammed", true, OutcomeRejected, true},
+		{"", false, OutcomeQueued, false},
+	} {
+		b.mu.Lock()
+		b.ackErr, b.open = tc.ackErr, tc.open
+		b.mu.Unlock()
+		ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+		err := m.SendUpPh(ctx, "tank-1")
+		parent.End()
+		var cmdErr *CommandError
+		if tc.failed != errors.As(err, &cmdErr) {
+			t.Fatalf("%s: unexpected error %v", tc.outcome, err)
+		}
+
+		var span sdktrace.ReadOnlySpan
+		for _, s := range endedSpans(parent.SpanContext().TraceID()) {
+			if s.Name() == "command send ph_up" {
+				span = s
+			}
+		}
+		if span == nil {
+			t.Fatalf("%s: no command span in the trace of the caller", tc.outcome)
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() || span.SpanKind() != trace.SpanKindProducer {
+			t.Errorf("%s: span %s is not a producer child of the caller", tc.outcome, span.Name())
+		}
+		if got := spanAttribute(span, "hydro.command.outcome").AsString(); got != string(tc.outcome) {
+			t.Errorf("outcome attribute %q, want %q", got, tc.outcome)
+		}
+		if (span.Status().Code == codes.Error) != tc.failed {
+			t.Errorf("%s: span status %v", tc.outcome, span.Status())
+		}
+		if tc.failed && len(span.Events()) == 0 {
+			t.Errorf("%s: error not recorded", tc.outcome)
+		}
+		if !tc.open {
+			continue
+		}
+
+		// the controller continues the trace from the message
+		sent := b.published()
+		msg := sent[len(sent)-1]
+		sc := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msg.Trace)))
+		if sc.TraceID() != parent.SpanContext().TraceID() || sc.SpanID() != span.SpanContext().SpanID() {
+			t.Errorf("%s: message carries %v, want the command span", tc.outcome, msg.Trace)
+		}
+	}
+}